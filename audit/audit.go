@@ -0,0 +1,172 @@
+// Package audit records every action of the deployer in an append-only log of JSON lines,
+// each line being an Entry. Long commands append their entry when they start, then again when they end
+// or are interrupted: entries with the same id are states of the same invocation, the last one is kept.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusStarted is the status of a command which hasn't ended yet, or was killed
+	StatusStarted = "started"
+	// StatusInterrupted is the status of a command which exited before its pipelines ended
+	StatusInterrupted = "interrupted"
+
+	// Redacted replaces the value of secret variables
+	Redacted = "[redacted]"
+)
+
+// SecretPattern matches names of variables whose value is never recorded
+var SecretPattern = regexp.MustCompile(`(?i)(token|secret|password|passwd|credential|private|key)`)
+
+// Entry is an invocation of the deployer which triggered pipelines
+type Entry struct {
+	Id        string      `json:"id,omitempty"`
+	Time      time.Time   `json:"time"`
+	Operator  string      `json:"operator"`
+	Action    string      `json:"action"`
+	Command   string      `json:"command"`
+	Status    string      `json:"status"`
+	Pipelines []*Pipeline `json:"pipelines"`
+}
+
+// Pipeline is a pipeline triggered for a client
+type Pipeline struct {
+	Client     string            `json:"client_id"`
+	App        string            `json:"app_name,omitempty"`
+	Ref        string            `json:"ref"`
+	Variables  map[string]string `json:"variables,omitempty"`
+	PipelineId int               `json:"pipeline_id,omitempty"`
+	Jobs       []*Job            `json:"jobs,omitempty"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	// Retryable tells if Error is transient (GitLab rate limiting or unavailable) rather than permanent
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// Job is a job played in a pipeline
+type Job struct {
+	Name   string `json:"name"`
+	Id     int    `json:"id,omitempty"`
+	Status string `json:"status"`
+}
+
+// Redact returns a copy of variables where values of variables matching SecretPattern are hidden
+func Redact(variables map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for key, value := range variables {
+		if SecretPattern.MatchString(key) {
+			value = Redacted
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// RedactCommand returns a command line from its arguments where values of KEY=VALUE variables (--var KEY=VALUE
+// or --var=KEY=VALUE) whose name matches SecretPattern are hidden
+func RedactCommand(args []string) string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		prefix := ""
+		if strings.HasPrefix(arg, "--var=") {
+			prefix, arg = "--var=", strings.TrimPrefix(arg, "--var=")
+		}
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 && SecretPattern.MatchString(parts[0]) {
+			arg = parts[0] + "=" + Redacted
+		}
+		redacted[i] = prefix + arg
+	}
+	return strings.Join(redacted, " ")
+}
+
+// Append adds an entry at the end of the log at path, which is created if needed
+func Append(path string, entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read returns every entry of the log at path, in time order. Only the last state of entries appended several
+// times is returned, at the place of the first one. A missing log has no entries
+func Read(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*Entry
+	positions := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+		if position, ok := positions[entry.Id]; ok && entry.Id != "" {
+			entries[position] = &entry
+			continue
+		}
+		positions[entry.Id] = len(entries)
+		entries = append(entries, &entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Filter selects pipelines of the log, empty fields match anything
+type Filter struct {
+	Client string
+	App    string
+	Action string
+	Status string
+	Since  time.Time
+	Until  time.Time
+}
+
+// Match tells if a pipeline of an entry is selected by the filter
+func (f *Filter) Match(entry *Entry, pipeline *Pipeline) bool {
+	switch {
+	case f.Client != "" && pipeline.Client != f.Client:
+		return false
+	case f.App != "" && pipeline.App != f.App:
+		return false
+	case f.Action != "" && entry.Action != f.Action:
+		return false
+	case f.Status != "" && pipeline.Status != f.Status:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && entry.Time.After(f.Until):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactCommand(t *testing.T) {
+	args := []string{"deploy", "acme", "api", "--var", "API_TOKEN=s3cr3t", "--var=db_password=hunter2", "--var", "ENV=prod", "--ref=v1.2"}
+
+	command := RedactCommand(args)
+
+	expected := "deploy acme api --var API_TOKEN=[redacted] --var=db_password=[redacted] --var ENV=prod --ref=v1.2"
+	if command != expected {
+		t.Errorf("expected %q, got %q", expected, command)
+	}
+}
+
+func TestReadKeepsLastStateOfEntries(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	for _, entry := range []*Entry{
+		{Id: "a", Action: "deploy", Status: StatusStarted},
+		{Id: "b", Action: "enable", Status: StatusSucceeded},
+		{Id: "a", Action: "deploy", Status: StatusInterrupted},
+		{Action: "delete", Status: StatusFailed},
+		{Action: "delete", Status: StatusSucceeded},
+	} {
+		if err := Append(path, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, entry := range entries {
+		statuses = append(statuses, entry.Action+":"+entry.Status)
+	}
+	expected := "deploy:interrupted,enable:succeeded,delete:failed,delete:succeeded"
+	if strings.Join(statuses, ",") != expected {
+		t.Errorf("expected entries %s, got %s", expected, strings.Join(statuses, ","))
+	}
+}
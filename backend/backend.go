@@ -0,0 +1,71 @@
+// Package backend abstracts the CI system deployments are launched on.
+//
+// Gitlab is the implementation used by the deployer, Fake is an in-memory one
+// used to exercise the deploy flows without any CI server.
+package backend
+
+import "time"
+
+// Job and pipeline statuses
+const (
+	StatusCreated  = "created"
+	StatusPending  = "pending"
+	StatusRunning  = "running"
+	StatusManual   = "manual"
+	StatusSuccess  = "success"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+	StatusSkipped  = "skipped"
+)
+
+// Backend triggers pipelines and manages their jobs
+type Backend interface {
+	// TriggerPipeline creates a pipeline on ref with the given variables
+	TriggerPipeline(ref string, variables map[string]string) (*Pipeline, error)
+	// GetPipeline returns the current state of a pipeline
+	GetPipeline(pipelineId int) (*Pipeline, error)
+	// CancelPipeline cancels every running job of a pipeline
+	CancelPipeline(pipelineId int) (*Pipeline, error)
+	// ListJobs returns every job of a pipeline
+	ListJobs(pipelineId int) ([]*Job, error)
+	// GetJob returns the current state of a job
+	GetJob(jobId int) (*Job, error)
+	// PlayJob starts a manual job
+	PlayJob(jobId int) (*Job, error)
+	// CancelJob cancels a job
+	CancelJob(jobId int) (*Job, error)
+	// RetryJob runs an ended job again, the returned job is the new one
+	RetryJob(jobId int) (*Job, error)
+	// GetTrace returns the whole log of a job
+	GetTrace(jobId int) ([]byte, error)
+	// JobURL returns the web page of a job
+	JobURL(jobId int) string
+}
+
+// Pipeline is a CI pipeline
+type Pipeline struct {
+	Id     int
+	Status string
+	Ref    string
+	Sha    string
+	// User who created the pipeline and when, if known
+	User      string
+	CreatedAt time.Time
+}
+
+// Job is a job of a pipeline
+type Job struct {
+	Id         int
+	PipelineId int
+	Name       string
+	Status     string
+}
+
+// IsTerminal tells if a job or pipeline status won't change anymore
+func IsTerminal(status string) bool {
+	switch status {
+	case StatusSuccess, StatusFailed, StatusCanceled, StatusSkipped:
+		return true
+	}
+	return false
+}
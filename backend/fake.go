@@ -0,0 +1,295 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Fake is an in-memory backend. Each triggered pipeline gets a manual job for every name of Jobs,
+// played jobs go through pending and running states before ending with the status given by Outcome.
+type Fake struct {
+	// Jobs are the names of the manual jobs created in each pipeline
+	Jobs []string
+	// Statuses are the statuses of jobs which aren't created manual, by job name
+	Statuses map[string]string
+	// Outcome returns the final status of a played job, success when nil
+	Outcome func(variables map[string]string, jobName string) string
+	// Fail returns the error a call to method should return for the pipeline with these variables, no error when nil
+	Fail func(method string, variables map[string]string) error
+	// Triggers records every triggered pipeline
+	Triggers []FakeTrigger
+
+	mu        sync.Mutex
+	lastId    int
+	pipelines map[int]*fakePipeline
+	jobs      map[int]*fakeJob
+}
+
+// FakeTrigger is a pipeline triggered on a Fake backend
+type FakeTrigger struct {
+	PipelineId int
+	Ref        string
+	Variables  map[string]string
+}
+
+type fakePipeline struct {
+	Pipeline
+	variables map[string]string
+	jobs      []*fakeJob
+}
+
+type fakeJob struct {
+	Job
+	pipeline *fakePipeline
+	trace    []byte
+	// retried jobs have been replaced by a new run and don't count in the pipeline status
+	retried bool
+}
+
+// NewFake returns a fake backend creating the given manual jobs in every pipeline
+func NewFake(jobs ...string) *Fake {
+	return &Fake{Jobs: jobs}
+}
+
+func (f *Fake) nextId() int {
+	f.lastId++
+	return f.lastId
+}
+
+func (f *Fake) fail(method string, variables map[string]string) error {
+	if f.Fail == nil {
+		return nil
+	}
+	return f.Fail(method, variables)
+}
+
+// TriggerPipeline creates a pipeline with a job for each of f.Jobs, manual unless it has a status in f.Statuses
+func (f *Fake) TriggerPipeline(ref string, variables map[string]string) (*Pipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("TriggerPipeline", variables); err != nil {
+		return nil, err
+	}
+	if f.pipelines == nil {
+		f.pipelines = make(map[int]*fakePipeline)
+		f.jobs = make(map[int]*fakeJob)
+	}
+
+	pipeline := &fakePipeline{
+		Pipeline:  Pipeline{Id: f.nextId(), Status: StatusManual, Ref: ref, Sha: "fake"},
+		variables: variables,
+	}
+	for _, name := range f.Jobs {
+		status := StatusManual
+		if f.Statuses[name] != "" {
+			status = f.Statuses[name]
+		}
+		job := &fakeJob{Job: Job{Id: f.nextId(), PipelineId: pipeline.Id, Name: name, Status: status}, pipeline: pipeline}
+		pipeline.jobs = append(pipeline.jobs, job)
+		f.jobs[job.Id] = job
+	}
+	pipeline.update()
+	f.pipelines[pipeline.Id] = pipeline
+	f.Triggers = append(f.Triggers, FakeTrigger{PipelineId: pipeline.Id, Ref: ref, Variables: variables})
+
+	result := pipeline.Pipeline
+	return &result, nil
+}
+
+// GetPipeline returns a pipeline, its status is computed from its jobs
+func (f *Fake) GetPipeline(pipelineId int) (*Pipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pipeline, err := f.pipeline("GetPipeline", pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	result := pipeline.Pipeline
+	return &result, nil
+}
+
+// CancelPipeline cancels every job of a pipeline which isn't over
+func (f *Fake) CancelPipeline(pipelineId int) (*Pipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pipeline, err := f.pipeline("CancelPipeline", pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range pipeline.jobs {
+		if !IsTerminal(job.Status) {
+			job.end(StatusCanceled)
+		}
+	}
+	pipeline.Status = StatusCanceled
+	result := pipeline.Pipeline
+	return &result, nil
+}
+
+// ListJobs returns the jobs of a pipeline
+func (f *Fake) ListJobs(pipelineId int) ([]*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pipeline, err := f.pipeline("ListJobs", pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, len(pipeline.jobs))
+	for i, job := range pipeline.jobs {
+		result := job.Job
+		jobs[i] = &result
+	}
+	return jobs, nil
+}
+
+// GetJob returns a job, each call makes a played job progress to its next state
+func (f *Fake) GetJob(jobId int) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.job("GetJob", jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	switch job.Status {
+	case StatusPending:
+		job.Status = StatusRunning
+		job.trace = append(job.trace, "Running job "+job.Name+"\n"...)
+	case StatusRunning:
+		status := StatusSuccess
+		if f.Outcome != nil {
+			status = f.Outcome(job.pipeline.variables, job.Name)
+		}
+		job.end(status)
+	}
+	job.pipeline.update()
+
+	result := job.Job
+	return &result, nil
+}
+
+// PlayJob starts a manual job
+func (f *Fake) PlayJob(jobId int) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.job("PlayJob", jobId)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusManual {
+		return nil, fmt.Errorf("job %d is %s, it can't be played", jobId, job.Status)
+	}
+	job.Status = StatusPending
+	job.pipeline.update()
+
+	result := job.Job
+	return &result, nil
+}
+
+// CancelJob cancels a job
+func (f *Fake) CancelJob(jobId int) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.job("CancelJob", jobId)
+	if err != nil {
+		return nil, err
+	}
+	if !IsTerminal(job.Status) {
+		job.end(StatusCanceled)
+	}
+	job.pipeline.update()
+
+	result := job.Job
+	return &result, nil
+}
+
+// RetryJob creates a pending copy of an ended job
+func (f *Fake) RetryJob(jobId int) (*Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.job("RetryJob", jobId)
+	if err != nil {
+		return nil, err
+	}
+	if !IsTerminal(job.Status) {
+		return nil, fmt.Errorf("job %d is %s, it can't be retried", jobId, job.Status)
+	}
+	retried := &fakeJob{Job: Job{Id: f.nextId(), PipelineId: job.PipelineId, Name: job.Name, Status: StatusPending}, pipeline: job.pipeline}
+	job.retried = true
+	job.pipeline.jobs = append(job.pipeline.jobs, retried)
+	f.jobs[retried.Id] = retried
+	job.pipeline.Status = StatusRunning
+	job.pipeline.update()
+
+	result := retried.Job
+	return &result, nil
+}
+
+// GetTrace returns what a job logged so far
+func (f *Fake) GetTrace(jobId int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.job("GetTrace", jobId)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), job.trace...), nil
+}
+
+// JobURL returns a fake job link
+func (f *Fake) JobURL(jobId int) string {
+	return "fake://jobs/" + strconv.Itoa(jobId)
+}
+
+func (f *Fake) pipeline(method string, pipelineId int) (*fakePipeline, error) {
+	pipeline, ok := f.pipelines[pipelineId]
+	if !ok {
+		return nil, fmt.Errorf("pipeline %d not found", pipelineId)
+	}
+	if err := f.fail(method, pipeline.variables); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+func (f *Fake) job(method string, jobId int) (*fakeJob, error) {
+	job, ok := f.jobs[jobId]
+	if !ok {
+		return nil, fmt.Errorf("job %d not found", jobId)
+	}
+	if err := f.fail(method, job.pipeline.variables); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (j *fakeJob) end(status string) {
+	j.Status = status
+	j.trace = append(j.trace, "Job "+j.Name+" ended with status "+status+"\n"...)
+}
+
+// update computes the pipeline status from its jobs
+func (p *fakePipeline) update() {
+	if p.Status == StatusCanceled {
+		return
+	}
+	status := StatusSuccess
+	for _, job := range p.jobs {
+		if job.retried {
+			continue
+		}
+		switch job.Status {
+		case StatusFailed, StatusCanceled:
+			p.Status = job.Status
+			return
+		case StatusPending, StatusRunning:
+			status = StatusRunning
+		case StatusManual:
+			if status == StatusSuccess {
+				status = StatusManual
+			}
+		}
+	}
+	p.Status = status
+}
@@ -0,0 +1,270 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Gitlab runs deployments on GitLab CI
+type Gitlab struct {
+	client        *gitlab.Client
+	project       int
+	pipelineToken string
+	projectURL    string
+}
+
+// NewGitlab returns a backend using the pipelines of project. The pipeline token is used to trigger
+// pipelines, projectURL is the web page of the project used to build job links.
+func NewGitlab(client *gitlab.Client, project int, pipelineToken string, projectURL string) *Gitlab {
+	return &Gitlab{
+		client:        client,
+		project:       project,
+		pipelineToken: pipelineToken,
+		projectURL:    strings.TrimSuffix(projectURL, "/"),
+	}
+}
+
+// Client returns the underlying GitLab API client
+func (g *Gitlab) Client() *gitlab.Client {
+	return g.client
+}
+
+// Project returns the id of the project pipelines are triggered on
+func (g *Gitlab) Project() int {
+	return g.project
+}
+
+// TriggerPipeline generates a pipeline from what has been configured in .gitlab-ci.yaml.
+// All jobs for this pipeline will be generated
+// Example: pipeline_id=$(curl -X POST -F "ref=deployer" -F "variables[client_id]=${client_id}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/trigger/pipeline?token=${gitlab_token}" | jq --raw-input '.id')
+func (g *Gitlab) TriggerPipeline(ref string, variables map[string]string) (*Pipeline, error) {
+	opt := &gitlab.RunPipelineTriggerOptions{
+		Token:     gitlab.String(g.pipelineToken),
+		Variables: variables,
+		Ref:       gitlab.String(ref),
+	}
+	pipeline, _, err := g.client.PipelineTriggers.RunPipelineTrigger(g.project, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(pipeline), nil
+}
+
+// GetPipeline gets a pipeline
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines/${pipeline_id}"
+func (g *Gitlab) GetPipeline(pipelineId int) (*Pipeline, error) {
+	pipeline, _, err := g.client.Pipelines.GetPipeline(g.project, pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(pipeline), nil
+}
+
+// CancelPipeline cancels the jobs of a pipeline
+// Example: curl -X POST --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines/${pipeline_id}/cancel"
+func (g *Gitlab) CancelPipeline(pipelineId int) (*Pipeline, error) {
+	pipeline, _, err := g.client.Pipelines.CancelPipelineBuild(g.project, pipelineId)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(pipeline), nil
+}
+
+// ListJobs gets all jobs from a pipeline ID, going through every page
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines/${pipeline_id}/jobs"
+func (g *Gitlab) ListJobs(pipelineId int) ([]*Job, error) {
+	var jobs []*Job
+	opt := &gitlab.ListJobsOptions{ListOptions: gitlab.ListOptions{PerPage: 100, Page: 1}}
+	for {
+		page, resp, err := g.client.Jobs.ListPipelineJobs(g.project, pipelineId, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range page {
+			jobs = append(jobs, newJob(pipelineId, job))
+		}
+		if resp.NextPage == 0 {
+			return jobs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// GetJob gets a job
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}"
+func (g *Gitlab) GetJob(jobId int) (*Job, error) {
+	job, _, err := g.client.Jobs.GetJob(g.project, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return newJob(0, job), nil
+}
+
+// PlayJob plays a manual job
+// Example: curl -X POST --header "PRIVATE-TOKEN: ${gitlab_token}" -F ref=deployer "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}/play"
+func (g *Gitlab) PlayJob(jobId int) (*Job, error) {
+	job, _, err := g.client.Jobs.PlayJob(g.project, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return newJob(0, job), nil
+}
+
+// CancelJob cancels a job
+// Example: curl -X POST --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}/cancel"
+func (g *Gitlab) CancelJob(jobId int) (*Job, error) {
+	job, _, err := g.client.Jobs.CancelJob(g.project, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return newJob(0, job), nil
+}
+
+// RetryJob retries an ended job
+// Example: curl -X POST --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}/retry"
+func (g *Gitlab) RetryJob(jobId int) (*Job, error) {
+	job, _, err := g.client.Jobs.RetryJob(g.project, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return newJob(0, job), nil
+}
+
+// GetTrace gets the log of a job
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}/trace"
+func (g *Gitlab) GetTrace(jobId int) ([]byte, error) {
+	reader, _, err := g.client.Jobs.GetTraceFile(g.project, jobId)
+	if err != nil {
+		return nil, err
+	}
+	var trace bytes.Buffer
+	if _, err := io.Copy(&trace, reader); err != nil {
+		return nil, err
+	}
+	return trace.Bytes(), nil
+}
+
+// JobURL returns the web page of a job
+func (g *Gitlab) JobURL(jobId int) string {
+	return g.projectURL + "/-/jobs/" + strconv.Itoa(jobId)
+}
+
+// RecentPipelines returns at most max pipelines of the project, the most recent first. Only ids, status, ref and sha are set
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines?order_by=id&sort=desc"
+func (g *Gitlab) RecentPipelines(max int) ([]*Pipeline, error) {
+	var pipelines []*Pipeline
+	opt := &gitlab.ListProjectPipelinesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100, Page: 1},
+		OrderBy:     gitlab.String("id"),
+		Sort:        gitlab.String("desc"),
+	}
+	for {
+		page, resp, err := g.client.Pipelines.ListProjectPipelines(g.project, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			if len(pipelines) == max {
+				return pipelines, nil
+			}
+			pipelines = append(pipelines, &Pipeline{Id: p.ID, Status: p.Status, Ref: p.Ref, Sha: p.Sha})
+		}
+		if resp.NextPage == 0 {
+			return pipelines, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// PipelineVariables returns the variables a pipeline has been triggered with
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines/${pipeline_id}/variables"
+func (g *Gitlab) PipelineVariables(pipelineId int) (map[string]string, error) {
+	req, err := g.client.NewRequest("GET", fmt.Sprintf("projects/%d/pipelines/%d/variables", g.project, pipelineId), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var list []*gitlab.PipelineVariable
+	if _, err := g.client.Do(req, &list); err != nil {
+		return nil, err
+	}
+	variables := make(map[string]string)
+	for _, v := range list {
+		variables[v.Key] = v.Value
+	}
+	return variables, nil
+}
+
+// EnvironmentDeployment is the deployment of a GitLab environment by a job
+type EnvironmentDeployment struct {
+	Environment string
+	Pipeline    *Pipeline
+	Job         *Job
+}
+
+// RecentDeployments returns at most max deployments of the project environments, the most recent first
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/deployments?order_by=id&sort=desc"
+func (g *Gitlab) RecentDeployments(max int) ([]*EnvironmentDeployment, error) {
+	var deployments []*EnvironmentDeployment
+	opt := &gitlab.ListProjectDeploymentsOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100, Page: 1},
+		OrderBy:     gitlab.String("id"),
+		Sort:        gitlab.String("desc"),
+	}
+	for {
+		page, resp, err := g.client.Deployments.ListProjectDeployments(g.project, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range page {
+			if len(deployments) == max {
+				return deployments, nil
+			}
+			deployment := &EnvironmentDeployment{
+				Pipeline: &Pipeline{Id: d.Deployable.Pipeline.ID, Status: d.Deployable.Pipeline.Status, Ref: d.Ref, Sha: d.Sha},
+				Job:      &Job{Id: d.Deployable.ID, PipelineId: d.Deployable.Pipeline.ID, Name: d.Deployable.Name, Status: d.Deployable.Status},
+			}
+			if d.Environment != nil {
+				deployment.Environment = d.Environment.Name
+			}
+			if d.User != nil {
+				deployment.Pipeline.User = d.User.Username
+			}
+			if d.CreatedAt != nil {
+				deployment.Pipeline.CreatedAt = *d.CreatedAt
+			}
+			deployments = append(deployments, deployment)
+		}
+		if resp.NextPage == 0 {
+			return deployments, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func newPipeline(pipeline *gitlab.Pipeline) *Pipeline {
+	p := &Pipeline{
+		Id:     pipeline.ID,
+		Status: pipeline.Status,
+		Ref:    pipeline.Ref,
+		Sha:    pipeline.Sha,
+		User:   pipeline.User.Username,
+	}
+	if pipeline.CreatedAt != nil {
+		p.CreatedAt = *pipeline.CreatedAt
+	}
+	return p
+}
+
+func newJob(pipelineId int, job *gitlab.Job) *Job {
+	return &Job{
+		Id:         job.ID,
+		PipelineId: pipelineId,
+		Name:       job.Name,
+		Status:     job.Status,
+	}
+}
@@ -0,0 +1,259 @@
+package backend_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	testProject  = 42
+	testToken    = "trigger-token"
+	testPipeline = 7
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// gitlabServer is a local GitLab API serving one pipeline. Its jobs are manual, a played job is running
+// until it has been checked twice then it ends with outcome
+type gitlabServer struct {
+	*httptest.Server
+	t *testing.T
+	// perPage is the number of jobs returned in a page of the pipeline jobs
+	perPage int
+	// outcome is the final status of played jobs, they keep running when empty
+	outcome string
+	// pipelineStatus is the status returned for the pipeline
+	pipelineStatus string
+
+	mu        sync.Mutex
+	jobs      []*gitlab.Job
+	checks    map[int]int
+	pages     []string
+	variables map[string]string
+}
+
+func newGitlabServer(t *testing.T, jobNames ...string) *gitlabServer {
+	s := &gitlabServer{t: t, perPage: 2, outcome: backend.StatusSuccess, pipelineStatus: backend.StatusRunning, checks: make(map[int]int)}
+	for i, name := range jobNames {
+		s.jobs = append(s.jobs, &gitlab.Job{ID: 100 + i, Name: name, Status: backend.StatusManual})
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// backend returns a GitLab backend on the server
+func (s *gitlabServer) backend() *backend.Gitlab {
+	client := gitlab.NewClient(s.Client(), "private-token")
+	if err := client.SetBaseURL(s.URL + "/api/v4"); err != nil {
+		s.t.Fatal(err)
+	}
+	return backend.NewGitlab(client, testProject, testToken, s.URL+"/deploy")
+}
+
+func (s *gitlabServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := fmt.Sprintf("/api/v4/projects/%d/", testProject)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	route := r.Method + " " + path[0]
+	if len(path) > 2 {
+		route += "/:id/" + path[2]
+	} else if len(path) > 1 {
+		route += "/:id"
+	}
+	id := 0
+	if len(path) > 1 {
+		id, _ = strconv.Atoi(path[1])
+	}
+
+	switch route {
+	case "POST trigger/:id":
+		var opts struct {
+			Token     string            `json:"token"`
+			Ref       string            `json:"ref"`
+			Variables map[string]string `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil || opts.Token != testToken {
+			http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		s.variables = opts.Variables
+		s.reply(w, &gitlab.Pipeline{ID: testPipeline, Status: backend.StatusPending, Ref: opts.Ref})
+	case "GET pipelines/:id":
+		s.reply(w, &gitlab.Pipeline{ID: id, Status: s.pipelineStatus})
+	case "GET pipelines/:id/jobs":
+		s.pages = append(s.pages, r.URL.Query().Get("page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		from, to := (page-1)*s.perPage, page*s.perPage
+		if to < len(s.jobs) {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		} else {
+			to = len(s.jobs)
+		}
+		if from > to {
+			from = to
+		}
+		s.reply(w, s.jobs[from:to])
+	case "GET jobs/:id", "POST jobs/:id/play":
+		job := s.job(id)
+		if job == nil {
+			http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPost {
+			job.Status = backend.StatusPending
+		} else if job.Status != backend.StatusManual && !backend.IsTerminal(job.Status) {
+			s.checks[id]++
+			job.Status = backend.StatusRunning
+			if s.checks[id] > 2 && s.outcome != "" {
+				job.Status = s.outcome
+			}
+		}
+		s.reply(w, job)
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+func (s *gitlabServer) job(id int) *gitlab.Job {
+	for _, job := range s.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (s *gitlabServer) reply(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// deploy deploys client on the server, waiting at most timeout for the jobs to end
+func (s *gitlabServer) deploy(client string, timeout time.Duration, jobs ...string) *deploy.Deployment {
+	dp := deploy.New(s.backend(), deploy.Options{Parallel: 1, Timeout: timeout, JobsTimeout: 20 * time.Millisecond, PollInterval: time.Millisecond})
+	deployments := dp.Launch([]string{client}, &deploy.Spec{App: "api", Ref: "master", Jobs: jobs})
+	dp.Wait(deployments, false)
+	return deployments[0]
+}
+
+func TestGitlabListJobsPaginated(t *testing.T) {
+	s := newGitlabServer(t, "build", "test", "deploy", "rollback", "cleanup")
+
+	jobs, err := s.backend().ListJobs(testPipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, job := range jobs {
+		if job.PipelineId != testPipeline {
+			t.Errorf("expected job %d to be in pipeline %d, got %d", job.Id, testPipeline, job.PipelineId)
+		}
+		names = append(names, job.Name)
+	}
+	if strings.Join(names, ",") != "build,test,deploy,rollback,cleanup" {
+		t.Errorf("expected the jobs of every page, got %v", names)
+	}
+	if strings.Join(s.pages, ",") != "1,2,3" {
+		t.Errorf("expected pages 1 to 3 to be requested, got %v", s.pages)
+	}
+}
+
+func TestGitlabDeploySuccess(t *testing.T) {
+	// deploy is on the last page
+	s := newGitlabServer(t, "build", "test", "deploy")
+
+	d := s.deploy("acme", 5*time.Second, "deploy")
+
+	if d.Status != backend.StatusSuccess || d.Error != nil {
+		t.Fatalf("expected the deployment to succeed, got %s (%v)", d.Status, d.Error)
+	}
+	if d.PipelineId != testPipeline || d.JobIds() != "102" {
+		t.Errorf("expected job 102 of pipeline %d to be played, got jobs %s of pipeline %d", testPipeline, d.JobIds(), d.PipelineId)
+	}
+	if s.variables["client_id"] != "acme" || s.variables["app_name"] != "api" {
+		t.Errorf("unexpected trigger variables %v", s.variables)
+	}
+	if s.job(100).Status != backend.StatusManual {
+		t.Errorf("expected job build not to be played, got %s", s.job(100).Status)
+	}
+}
+
+func TestGitlabDeployFailed(t *testing.T) {
+	s := newGitlabServer(t, "deploy")
+	s.outcome = backend.StatusFailed
+
+	d := s.deploy("acme", 5*time.Second, "deploy")
+
+	if d.Status != backend.StatusFailed {
+		t.Fatalf("expected the deployment to fail, got %s", d.Status)
+	}
+	if d.Jobs[0].Status != backend.StatusFailed {
+		t.Errorf("expected job status failed, got %s", d.Jobs[0].Status)
+	}
+}
+
+func TestGitlabDeployCanceledPipeline(t *testing.T) {
+	// The pipeline has been canceled while the job is left running
+	s := newGitlabServer(t, "deploy")
+	s.outcome = ""
+	s.pipelineStatus = backend.StatusCanceled
+
+	d := s.deploy("acme", 5*time.Second, "deploy")
+
+	if d.Status != backend.StatusCanceled {
+		t.Fatalf("expected the deployment to be canceled, got %s", d.Status)
+	}
+}
+
+func TestGitlabDeployTimeout(t *testing.T) {
+	s := newGitlabServer(t, "deploy")
+	s.outcome = ""
+
+	d := s.deploy("acme", 50*time.Millisecond, "deploy")
+
+	if d.Status != deploy.StatusTimeout {
+		t.Fatalf("expected the deployment to time out, got %s", d.Status)
+	}
+	if s.checks[100] < 2 {
+		t.Errorf("expected the job to be checked until the timeout, got %d checks", s.checks[100])
+	}
+}
+
+func TestGitlabDeployMissingJob(t *testing.T) {
+	s := newGitlabServer(t, "build", "test", "deploy")
+
+	d := s.deploy("acme", 5*time.Second, "migrate")
+
+	if d.Status != deploy.StatusError || d.Error == nil || !strings.Contains(d.Error.Error(), "available jobs: build, test, deploy") {
+		t.Fatalf("expected a missing job error listing every job, got %s (%v)", d.Status, d.Error)
+	}
+}
@@ -0,0 +1,313 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// maxRetryAfter bounds the delay asked by a Retry-After or RateLimit-Reset header
+const maxRetryAfter = 5 * time.Minute
+
+// RetryOptions tunes how failed GitLab API calls are retried and how fast requests are sent
+type RetryOptions struct {
+	// MaxRetries is the number of times a failed call is retried, 0 disables retries
+	MaxRetries int
+	// MinBackoff is the delay before the first retry, doubled at each retry up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RequestsPerSecond limits the rate of requests, unlimited when 0
+	RequestsPerSecond float64
+	// Burst is the number of requests which can be sent at once when the rate is limited
+	Burst int
+}
+
+// retryTransport sends requests with a client, retrying them on rate limiting and transient errors
+type retryTransport struct {
+	client  *http.Client
+	opts    RetryOptions
+	limiter *rateLimiter
+}
+
+// NewRetryTransport returns a transport sending requests with client, its timeout applying to each attempt.
+// Requests are retried with exponential backoff and jitter when GitLab is rate limiting (429) or unavailable,
+// waiting as long as asked by Retry-After and RateLimit-Reset headers.
+// Requests which may have been processed (POST, PUT...) are only retried when GitLab tells they haven't been.
+func NewRetryTransport(client *http.Client, opts RetryOptions) http.RoundTripper {
+	return &retryTransport{client: client, opts: opts, limiter: newRateLimiter(opts.RequestsPerSecond, opts.Burst)}
+}
+
+// RoundTrip sends a request, retrying it when needed
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body is kept to be sent again
+	if req.Body != nil && req.GetBody == nil && t.opts.MaxRetries > 0 {
+		content, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(content))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req); err != nil {
+			return nil, err
+		}
+		sent := req
+		if attempt > 0 {
+			sent = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				sent.Body = body
+			}
+		}
+		resp, err := t.client.Do(sent)
+		if resp != nil {
+			t.limiter.observe(resp)
+		}
+
+		reason := retryReason(req, resp, err)
+		if reason == "" || attempt >= t.opts.MaxRetries {
+			// The client calling the transport reports the method and URL already
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return resp, err
+		}
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp.Header); ok {
+				delay = after
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Warnf("GitLab %s %s: %s, retrying in %s (%d/%d)", req.Method, req.URL.Path, reason, delay.Round(time.Millisecond), attempt+1, t.opts.MaxRetries)
+		if err := sleep(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before a retry: MinBackoff doubled at each attempt up to MaxBackoff,
+// randomly reduced by up to a half so concurrent clients don't retry at the same time
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.opts.MinBackoff
+	for i := 0; i < attempt && delay < t.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if t.opts.MaxBackoff > 0 && delay > t.opts.MaxBackoff {
+		delay = t.opts.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryReason tells why a request has to be retried, empty when it doesn't
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	idempotent := false
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		idempotent = true
+	}
+	if err != nil {
+		if permanent(err) {
+			return ""
+		}
+		// The request hasn't been sent when the connection couldn't be made
+		var opErr *net.OpError
+		if idempotent || (errors.As(err, &opErr) && opErr.Op == "dial") {
+			return err.Error()
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return resp.Status
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		if idempotent {
+			return resp.Status
+		}
+	}
+	return ""
+}
+
+// retryAfter returns the delay asked by GitLab before sending a request again: Retry-After (seconds or date),
+// or the time left until RateLimit-Reset (unix time)
+func retryAfter(header http.Header) (time.Duration, bool) {
+	var delay time.Duration
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			delay = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			delay = time.Until(date)
+		} else {
+			return 0, false
+		}
+	} else if reset, ok := rateLimitReset(header); ok {
+		delay = time.Until(reset)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
+}
+
+// rateLimitReset returns when the rate limit window of GitLab resets
+func rateLimitReset(header http.Header) (time.Time, bool) {
+	reset, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(reset, 0), true
+}
+
+// sleep waits for delay, unless the request is canceled before
+func sleep(req *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// rateLimiter spaces requests to send at most rate requests per second after a burst, and pauses them when
+// GitLab tells no request is left in its rate limit window
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	// next is when the next request would be sent without burst
+	next        time.Time
+	pausedUntil time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{burst: burst}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
+
+// wait blocks until a request can be sent
+func (l *rateLimiter) wait(req *http.Request) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := now
+	if l.interval > 0 {
+		next := l.next
+		if next.Before(now) {
+			next = now
+		}
+		at = next.Add(-time.Duration(l.burst-1) * l.interval)
+		if at.Before(now) {
+			at = now
+		}
+		l.next = next.Add(l.interval)
+	}
+	if at.Before(l.pausedUntil) {
+		at = l.pausedUntil
+	}
+	l.mu.Unlock()
+
+	if delay := time.Until(at); delay > 0 {
+		log.Debugf("Waiting %s before sending GitLab request %s %s", delay.Round(time.Millisecond), req.Method, req.URL.Path)
+		return sleep(req, delay)
+	}
+	return nil
+}
+
+// observe pauses requests until the rate limit window resets when a response tells none is left
+func (l *rateLimiter) observe(resp *http.Response) {
+	if resp.Header.Get("RateLimit-Remaining") != "0" {
+		return
+	}
+	reset, ok := rateLimitReset(resp.Header)
+	if !ok {
+		return
+	}
+	if max := time.Now().Add(maxRetryAfter); reset.After(max) {
+		reset = max
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if reset.After(l.pausedUntil) {
+		log.Warnf("GitLab rate limit reached, pausing requests until %s", reset.Local().Format("15:04:05"))
+		l.pausedUntil = reset
+	}
+}
+
+// IsRetryable tells if a failed call may succeed when made again: GitLab was rate limiting, unavailable or
+// couldn't be reached. Other errors (not found, forbidden, invalid request, untrusted certificate, unknown host...)
+// are permanent
+func IsRetryable(err error) bool {
+	var response *gitlab.ErrorResponse
+	if errors.As(err, &response) {
+		switch response.Response.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if permanent(err) {
+		return false
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// permanent tells if a transport error comes from the settings or the request rather than from GitLab being
+// unreachable: untrusted or invalid certificate, TLS misconfiguration, unknown host name or canceled request
+func permanent(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCertificate x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCertificate), errors.As(err, &hostname),
+		errors.As(err, &recordHeader), errors.Is(err, context.Canceled):
+		return true
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsNotFound
+	}
+	return false
+}
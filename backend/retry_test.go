@@ -0,0 +1,107 @@
+package backend_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+)
+
+// retryClient returns a client retrying requests with client, at most 3 times without delay
+func retryClient(client *http.Client) *http.Client {
+	return &http.Client{Transport: backend.NewRetryTransport(client, backend.RetryOptions{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resp, err := retryClient(server.Client()).Post(server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %s after %d", resp.Status, attempts)
+	}
+}
+
+func TestRetryKeepsCreatingRequestsOnServerErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	resp, err := retryClient(server.Client()).Post(server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if attempts != 1 {
+		t.Errorf("expected a POST which may have been processed not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestRetryUntrustedCertificate(t *testing.T) {
+	var handshakes int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		atomic.AddInt32(&handshakes, 1)
+		return nil, nil
+	}}
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	// The client doesn't trust the test certificate
+	_, err := retryClient(&http.Client{}).Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+	if handshakes != 1 {
+		t.Errorf("expected an untrusted certificate not to be retried, got %d handshakes", handshakes)
+	}
+	if backend.IsRetryable(err) {
+		t.Errorf("expected %q to be permanent", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://gitlab.example.com/api/v4/projects/1", Err: err}
+	}
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{urlError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+		{urlError(&net.DNSError{Name: "gitlab.example.com", Err: "i/o timeout", IsTimeout: true}), true},
+		{urlError(&net.DNSError{Name: "gitlab.example.com", Err: "no such host", IsNotFound: true}), false},
+		{urlError(context.Canceled), false},
+		{errors.New("job deploy not found"), false},
+	} {
+		if retryable := backend.IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("expected %q retryable: %t, got %t", test.err, test.retryable, retryable)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// defaultAuditLog is the audit log written when audit_log isn't set
+const defaultAuditLog = "deploy-audit.jsonl"
+
+// auditLog returns the path of the audit log
+func auditLog() string {
+	return firstString(viper.GetString("audit_log"), defaultAuditLog)
+}
+
+// newAuditEntry starts the audit entry of a command
+func newAuditEntry(cmd *cobra.Command) *audit.Entry {
+	now := time.Now().UTC()
+	return &audit.Entry{
+		Id:       strconv.FormatInt(now.UnixNano(), 36),
+		Time:     now,
+		Operator: operator(),
+		Action:   cmd.Name(),
+		Command:  audit.RedactCommand(os.Args[1:]),
+	}
+}
+
+// auditPipelines adds the pipelines triggered for deployments of spec to the audit entry
+func auditPipelines(entry *audit.Entry, spec *deploy.Spec, deployments []*deploy.Deployment) {
+	for _, d := range deployments {
+		pipeline := &audit.Pipeline{
+			Client:     d.Client,
+			App:        spec.App,
+			Ref:        spec.Ref,
+			Variables:  audit.Redact(spec.TriggerVariables(d.Client)),
+			PipelineId: d.PipelineId,
+			Status:     d.Status,
+		}
+		for _, job := range d.Jobs {
+			pipeline.Jobs = append(pipeline.Jobs, &audit.Job{Name: job.Name, Id: job.Id, Status: job.Status})
+		}
+		if d.Error != nil {
+			pipeline.Error = d.Error.Error()
+			pipeline.Retryable = d.Retryable
+		}
+		entry.Pipelines = append(entry.Pipelines, pipeline)
+	}
+}
+
+// startRunAudit appends the entry of a command deploying the clients of a run before they are deployed, so the
+// command is recorded even if it's killed. If it exits with log.Fatal, the entry is appended again with the deployments
+// launched so far. The returned function ends this, the final entry being saved by the command
+func startRunAudit(entry *audit.Entry, run *deploy.Run, recorder *runRecorder) func() {
+	var planned []*deploy.Deployment
+	for _, d := range run.Deployments() {
+		if !d.Succeeded() {
+			planned = append(planned, &deploy.Deployment{Client: d.Client})
+		}
+	}
+	auditPipelines(entry, run.Spec, planned)
+	entry.Status = audit.StatusStarted
+	appendAudit(entry)
+	entry.Pipelines = nil
+
+	return atFatal(func() {
+		interrupted := *entry
+		auditPipelines(&interrupted, run.Spec, recorder.deployments())
+		interrupted.Status = audit.StatusInterrupted
+		appendAudit(&interrupted)
+	})
+}
+
+// saveAudit appends the entry to the audit log, failing to do so doesn't stop the command
+func saveAudit(entry *audit.Entry) {
+	saveAuditExpecting(entry, backend.StatusSuccess)
+}
+
+// saveAuditExpecting appends the entry to the audit log, the command succeeded if every pipeline has the expected status
+func saveAuditExpecting(entry *audit.Entry, expected string) {
+	entry.Status = audit.StatusSucceeded
+	for _, pipeline := range entry.Pipelines {
+		if pipeline.Status != expected {
+			entry.Status = audit.StatusFailed
+		}
+	}
+	appendAudit(entry)
+}
+
+// appendAudit appends the entry to the audit log as it is
+func appendAudit(entry *audit.Entry) {
+	if err := audit.Append(auditLog(), entry); err != nil {
+		log.Errorf("Wasn't able to write audit log %s: %s", auditLog(), err)
+	}
+}
+
+// operator returns who runs the deployer: the operator setting or the current user
+func operator() string {
+	if name := viper.GetString("operator"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel <client id|pattern|all> [app name]",
+	Short: "Cancel running deployments of client applications",
+	Long: `Cancel the jobs and pipeline of the last deployment of client applications when it's still running.
+Deployments are looked up like status does, or only in the pipelines recorded in the audit log with --from-audit`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Infof("Canceling %s requested", args[0])
+
+		git := newBackend()
+		statuses, err := launchedPipelines(cmd, git, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var running []*appStatus
+		for _, status := range statuses {
+			switch status.Status {
+			case backend.StatusCreated, backend.StatusPending, backend.StatusRunning:
+				running = append(running, status)
+			}
+		}
+		running = pipelineStatuses(running)
+		if len(running) == 0 {
+			log.Info("No running deployment found")
+			return
+		}
+		if err := printStatus(running, "table"); err != nil {
+			log.Fatal(err)
+		}
+		if !confirmed(cmd, fmt.Sprintf("Cancel %d pipeline(s)? [y/N] ", len(running))) {
+			return
+		}
+
+		entry := newAuditEntry(cmd)
+		failed := 0
+		for _, status := range running {
+			pipeline := &audit.Pipeline{Client: status.Client, App: status.App, Ref: status.Ref, PipelineId: status.PipelineId, Jobs: status.Jobs}
+			entry.Pipelines = append(entry.Pipelines, pipeline)
+			for _, job := range status.Jobs {
+				if backend.IsTerminal(job.Status) {
+					continue
+				}
+				canceled, err := git.CancelJob(job.Id)
+				if err != nil {
+					log.Errorf("Wasn't able to cancel job %s (%d) of %s/%s: %s", job.Name, job.Id, status.Client, status.App, err)
+					continue
+				}
+				job.Status = canceled.Status
+			}
+			canceled, err := git.CancelPipeline(status.PipelineId)
+			if err != nil {
+				log.Errorf("Wasn't able to cancel pipeline %d of %s/%s: %s", status.PipelineId, status.Client, status.App, err)
+				pipeline.Status = status.Status
+				pipeline.Error = err.Error()
+				failed++
+				continue
+			}
+			log.Infof("Pipeline %d of %s/%s canceled", status.PipelineId, status.Client, status.App)
+			pipeline.Status = backend.StatusCanceled
+			if backend.IsTerminal(canceled.Status) {
+				pipeline.Status = canceled.Status
+			}
+		}
+		saveAuditExpecting(entry, backend.StatusCanceled)
+		if failed > 0 {
+			log.Fatalf("%d/%d pipeline(s) have not been canceled", failed, len(running))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+
+	addSelectorFlags(cancelCmd)
+	addLaunchedPipelinesFlags(cancelCmd)
+	cancelCmd.Flags().Bool("dry-run", false, "only show the deployments which would be canceled")
+	cancelCmd.Flags().BoolP("yes", "y", false, "cancel without being prompted")
+}
+
+// addLaunchedPipelinesFlags adds the flags telling how launchedPipelines finds deployments
+func addLaunchedPipelinesFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("from-audit", false, "only look for pipelines recorded in the audit log")
+	cmd.Flags().Int("max-pipelines", 100, "number of recent pipelines (or environment deployments) looked up (status_max_pipelines setting)")
+}
+
+// launchedPipelines returns the last deployment of the selected client applications, found like status does,
+// or with --from-audit in the pipelines triggered from here
+func launchedPipelines(cmd *cobra.Command, git *backend.Gitlab, args []string) ([]*appStatus, error) {
+	target := registry.All
+	if len(args) >= 1 {
+		target = args[0]
+	}
+	statuses, err := selectAppStatuses(cmd, target, args)
+	if err != nil {
+		return nil, err
+	}
+	if fromAudit, _ := cmd.Flags().GetBool("from-audit"); fromAudit {
+		err = statusFromAudit(git, statuses)
+	} else {
+		err = findDeployments(git, statuses, maxPipelines(cmd))
+	}
+	if err != nil {
+		return nil, err
+	}
+	statusOperators(statuses)
+	return statuses, nil
+}
+
+// statusFromAudit fills statuses from the last deployment recorded for each client app in the audit log
+func statusFromAudit(git backend.Backend, statuses []*appStatus) error {
+	entries, err := audit.Read(auditLog())
+	if err != nil {
+		return fmt.Errorf("wasn't able to read audit log %s: %s", auditLog(), err)
+	}
+	pipelines := make(map[*appStatus]*audit.Pipeline)
+	for _, entry := range entries {
+		for _, pipeline := range entry.Pipelines {
+			var jobs []string
+			for _, job := range pipeline.Jobs {
+				jobs = append(jobs, job.Name)
+			}
+			if pipeline.PipelineId == 0 || !deploysApp(pipeline.App, jobs) {
+				continue
+			}
+			for _, status := range findStatuses(statuses, pipeline.Client, pipeline.App) {
+				pipelines[status] = pipeline
+			}
+		}
+	}
+	for _, status := range statuses {
+		if pipeline, ok := pipelines[status]; ok {
+			if err := status.setPipelineJobs(git, pipeline.PipelineId); err != nil {
+				return err
+			}
+			status.Sha = deployedSha(status.Sha, pipeline.Variables)
+		}
+	}
+	return nil
+}
+
+// pipelineStatuses returns the statuses of distinct pipelines, a pipeline deploying every app of a client
+// being found for each of them
+func pipelineStatuses(statuses []*appStatus) []*appStatus {
+	var distinct []*appStatus
+	seen := make(map[int]bool)
+	for _, status := range statuses {
+		if !seen[status.PipelineId] {
+			seen[status.PipelineId] = true
+			distinct = append(distinct, status)
+		}
+	}
+	return distinct
+}
+
+// confirmed asks the operator to confirm an action, unless --yes is set. It returns false with --dry-run
+func confirmed(cmd *cobra.Command, question string) bool {
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		return false
+	}
+	if yes, _ := cmd.Flags().GetBool("yes"); yes {
+		return true
+	}
+	if answer := prompt(question); answer != "y" && answer != "yes" {
+		log.Fatal("Aborted")
+	}
+	return true
+}
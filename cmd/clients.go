@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// clientsCmd represents the clients command
+var clientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Manage the clients file",
+}
+
+// clientsListCmd represents the clients list command
+var clientsListCmd = &cobra.Command{
+	Use:   "list [client id|pattern|all]",
+	Short: "List clients, use selector flags to preview the clients a command would run on",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := registry.All
+		if len(args) == 1 {
+			target = args[0]
+		}
+		reg := loadRegistry()
+		clients, err := selectClients(cmd, reg, target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printClients(reg, clients)
+	},
+}
+
+// clientsShowCmd represents the clients show command
+var clientsShowCmd = &cobra.Command{
+	Use:   "show <client id>",
+	Short: "Show every column of a client",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reg := loadRegistry()
+		client := reg.Get(args[0])
+		if client == nil {
+			log.Fatalf("Client %s has not been found in %s", args[0], reg.Path)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		values := clientValues(reg, client)
+		for i, column := range reg.Columns {
+			fmt.Fprintf(w, "%s:\t%s\n", column, values[i])
+		}
+		fmt.Fprintf(w, "line:\t%d\n", client.Line)
+		w.Flush()
+	},
+}
+
+// clientsAddAppCmd represents the clients add-app command
+var clientsAddAppCmd = &cobra.Command{
+	Use:   "add-app <client id|pattern|all> <app name>...",
+	Short: "Add applications to clients",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateClients(cmd, args[0], "Add %s to %d client(s)", args[1:], (*registry.Registry).AddApp)
+	},
+}
+
+// clientsRemoveAppCmd represents the clients remove-app command
+var clientsRemoveAppCmd = &cobra.Command{
+	Use:   "remove-app <client id|pattern|all> <app name>...",
+	Short: "Remove applications from clients, they aren't torn down",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateClients(cmd, args[0], "Remove %s from %d client(s)", args[1:], (*registry.Registry).RemoveApp)
+	},
+}
+
+// clientsTagCmd represents the clients tag command
+var clientsTagCmd = &cobra.Command{
+	Use:   "tag <client id|pattern|all> <tag>...",
+	Short: "Tag clients",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateClients(cmd, args[0], "Tag %s %d client(s)", args[1:], (*registry.Registry).AddTag)
+	},
+}
+
+// clientsUntagCmd represents the clients untag command
+var clientsUntagCmd = &cobra.Command{
+	Use:   "untag <client id|pattern|all> <tag>...",
+	Short: "Remove tags from clients",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateClients(cmd, args[0], "Untag %s from %d client(s)", args[1:], (*registry.Registry).RemoveTag)
+	},
+}
+
+// clientsValidateCmd represents the clients validate command
+var clientsValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the clients file, every error is reported with its line number",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		reg := loadRegistry()
+		fmt.Printf("%s is valid: %d client(s), %d deleted\n", reg.Path, len(reg.Clients), len(reg.Tombstones))
+	},
+}
+
+// clientsVariablesCmd represents the clients variables command
+var clientsVariablesCmd = &cobra.Command{
+	Use:   "variables <client id> [app name]",
+	Short: "Show the pipeline variables of a client deploy and where they come from",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		reg := loadRegistry()
+		client := reg.Get(args[0])
+		if client == nil {
+			log.Fatalf("Client %s has not been found in %s", args[0], reg.Path)
+		}
+		app := ""
+		if len(args) == 2 {
+			app = args[1]
+		}
+		layers, err := resolveVariableLayers(cmd, reg, client, app)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// The last layer setting a variable wins
+		sources := make(map[string]string)
+		for _, layer := range layers {
+			for key := range layer.variables {
+				sources[key] = layer.source
+			}
+		}
+		spec := &deploy.Spec{App: app, Variables: layers.merged()}
+		variables := audit.Redact(spec.TriggerVariables(client.Id))
+		var keys []string
+		for key := range variables {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VARIABLE\tVALUE\tSOURCE")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", key, variables[key], firstString(sources[key], "deployer"))
+		}
+		w.Flush()
+	},
+}
+
+// clientsConvertCmd represents the clients convert command
+var clientsConvertCmd = &cobra.Command{
+	Use:   "convert <output file>",
+	Short: "Convert the clients file to another format (.csv, .yaml or .json)",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reg := loadRegistry()
+		if _, err := os.Stat(args[0]); err == nil {
+			if force, _ := cmd.Flags().GetBool("force"); !force {
+				log.Fatalf("%s already exists, use --force to overwrite it", args[0])
+			}
+		}
+
+		source := reg.Path
+		if err := reg.Convert(args[0]); err != nil {
+			log.Fatal(err)
+		}
+		if err := reg.Save(); err != nil {
+			log.Fatalf("Wasn't able to write %s: %s", reg.Path, err)
+		}
+		log.Infof("%d client(s) and %d deleted client(s) of %s written to %s, use it with --clientfile %s",
+			len(reg.Clients), len(reg.Tombstones), source, reg.Path, reg.Path)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(clientsCmd)
+	clientsCmd.AddCommand(clientsListCmd, clientsShowCmd, clientsAddAppCmd, clientsRemoveAppCmd, clientsTagCmd, clientsUntagCmd, clientsValidateCmd, clientsVariablesCmd, clientsConvertCmd)
+	clientsVariablesCmd.Flags().StringArray("var", nil, "extra pipeline variable as KEY=VALUE, can be repeated")
+	clientsConvertCmd.Flags().Bool("force", false, "overwrite the output file if it exists")
+	addSelectorFlags(clientsListCmd)
+	for _, cmd := range []*cobra.Command{clientsAddAppCmd, clientsRemoveAppCmd, clientsTagCmd, clientsUntagCmd} {
+		addSelectorFlags(cmd)
+		cmd.Flags().Bool("commit", false, "commit the clients file change to the deploy repository")
+	}
+}
+
+// updateClients applies change with every value to the selected clients, then saves the clients file.
+// Nothing is saved if one change fails
+func updateClients(cmd *cobra.Command, target string, message string, values []string, change func(*registry.Registry, string, string) error) {
+	reg := loadRegistry()
+	clients, err := selectClients(cmd, reg, target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, client := range clients {
+		for _, value := range values {
+			if err := change(reg, client.Id, value); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	commit, _ := cmd.Flags().GetBool("commit")
+	if err := saveRegistry(reg, fmt.Sprintf(message, strings.Join(values, ", "), len(clients)), commit); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// printClients prints clients as a table with every column of the clients file
+func printClients(reg *registry.Registry, clients []*registry.Client) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(reg.Columns, "\t")))
+	for _, client := range clients {
+		fmt.Fprintln(w, strings.Join(clientValues(reg, client), "\t"))
+	}
+	w.Flush()
+}
+
+// clientValues returns the values of a client in the clients file column order
+func clientValues(reg *registry.Registry, client *registry.Client) []string {
+	values := make([]string, len(reg.Columns))
+	for i, column := range reg.Columns {
+		switch column {
+		case registry.ColumnId:
+			values[i] = client.Id
+		case registry.ColumnApps:
+			values[i] = strings.Join(client.Apps, registry.ListSeparator)
+		case registry.ColumnTags:
+			values[i] = strings.Join(client.Tags, registry.ListSeparator)
+		default:
+			values[i] = client.Attributes[column]
+		}
+	}
+	return values
+}
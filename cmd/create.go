@@ -1,30 +1,90 @@
 package cmd
 
 import (
-	"fmt"
+	"os"
 
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // createCmd represents the create command
 var createCmd = &cobra.Command{
-	Use:   "create",
-	Short: "Create client ID and deploy its applications (not implemented)",
+	Use:   "create <client id>",
+	Short: "Create client ID and deploy its applications",
+	Long: `Add a client to the clients file, trigger the pipeline creating the client (create_job setting,
+add-client by default) then deploy its applications`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("create called")
+		clientId := args[0]
+		apps, _ := cmd.Flags().GetStringSlice("apps")
+		tags, _ := cmd.Flags().GetStringSlice("tags")
+		commit, _ := cmd.Flags().GetBool("commit")
+		log.Infof("Creating client %s requested", clientId)
+
+		// Add the client to the registry
+		reg := loadRegistry()
+		if err := reg.Add(&registry.Client{Id: clientId, Apps: apps, Tags: tags}); err != nil {
+			log.Fatal(err)
+		}
+		unlock := acquireLocks(cmd, []string{clientId}, "create "+clientId)
+		defer unlock()
+		if err := saveRegistry(reg, "Add client "+clientId, commit); err != nil {
+			log.Fatal(err)
+		}
+
+		// Trigger the client creation job
+		spec, err := newDeploySpec(cmd, reg, []string{clientId})
+		if err != nil {
+			log.Fatal(err)
+		}
+		spec.Jobs = []string{firstString(viper.GetString("create_job"), defaultCreateJobName)}
+		entry := newAuditEntry(cmd)
+		deployer := newDeployer(false)
+		created := deployer.Launch([]string{clientId}, spec)
+		deployer.Wait(created, false)
+		auditPipelines(entry, spec, created)
+		if !created[0].Succeeded() {
+			saveAudit(entry)
+			deploy.PrintSummary(os.Stdout, created)
+			log.Fatalf("Client %s has been added to %s but its creation job did not succeed", clientId, reg.Path)
+		}
+
+		// Deploy the client applications
+		var deployments []*deploy.Deployment
+		for _, app := range apps {
+			spec, err := newDeploySpec(cmd, reg, []string{clientId, app})
+			if err != nil {
+				log.Fatal(err)
+			}
+			launched := deployer.Launch([]string{clientId}, spec)
+			deployer.Wait(launched, false)
+			auditPipelines(entry, spec, launched)
+			deployments = append(deployments, launched...)
+		}
+		saveAudit(entry)
+		if len(deployments) == 0 {
+			log.Infof("Client %s created", clientId)
+			return
+		}
+		if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+			log.Fatalf("Client %s created but %d/%d application(s) did not deploy", clientId, failed, len(deployments))
+		}
+		log.Infof("Client %s created and its applications deployed", clientId)
 	},
 }
 
+// defaultCreateJobName is the job creating a client when create_job isn't set
+const defaultCreateJobName = "add-client"
+
 func init() {
 	rootCmd.AddCommand(createCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// createCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// createCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	createCmd.Flags().StringSlice("apps", nil, "applications of the client, deployed once it's created")
+	createCmd.Flags().StringSlice("tags", nil, "tags of the client")
+	createCmd.Flags().Bool("commit", false, "commit the clients file change to the deploy repository")
+	createCmd.Flags().String("ref", "", "branch or tag pipelines are triggered on (default master)")
+	addLockFlags(createCmd)
 }
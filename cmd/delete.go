@@ -1,30 +1,119 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// defaultDeleteJobName is the job removing a client application when delete_jobs isn't set
+const defaultDeleteJobName = "remove-client"
+
 // deleteCmd represents the delete command
 var deleteCmd = &cobra.Command{
-	Use:   "delete",
-	Short: "Delete client ID (not implemented)",
+	Use:   "delete <client id>",
+	Short: "Delete client ID",
+	Long: `Run the teardown jobs of every client application (delete_jobs and delete_data_jobs settings),
+then remove the client from the clients file. A tombstone is kept so the client id can't be reused`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("delete called")
+		clientId := args[0]
+		keepData, _ := cmd.Flags().GetBool("keep-data")
+		commit, _ := cmd.Flags().GetBool("commit")
+		log.Infof("Deleting client %s requested", clientId)
+
+		reg := loadRegistry()
+		client := reg.Get(clientId)
+		if client == nil {
+			log.Fatalf("Client %s has not been found in %s", clientId, reg.Path)
+		}
+
+		// Teardown jobs of every application
+		var specs []*deploy.Spec
+		var plan []deploy.PlannedPipeline
+		for _, app := range client.Apps {
+			spec, err := newDeploySpec(cmd, reg, []string{clientId, app})
+			if err != nil {
+				log.Fatal(err)
+			}
+			spec.Jobs = appSettingSlice(app, "delete_jobs", "delete_jobs", []string{defaultDeleteJobName})
+			if !keepData {
+				spec.Jobs = append(spec.Jobs, appSettingSlice(app, "delete_data_jobs", "delete_data_jobs", nil)...)
+			}
+			specs = append(specs, spec)
+			plan = append(plan, deploy.Plan([][]string{{clientId}}, spec, projectLabel())...)
+		}
+
+		unlock := acquireLocks(cmd, []string{clientId}, "delete "+clientId)
+		defer unlock()
+
+		// Show what will be removed and ask for confirmation
+		fmt.Printf("Client %s (%s line %d) will be deleted\n", clientId, reg.Path, client.Line)
+		if len(plan) > 0 {
+			fmt.Println("The following teardown pipelines will be triggered:")
+			deploy.PrintPlan(os.Stdout, plan, "table")
+		}
+		if keepData {
+			fmt.Println("Data teardown jobs are skipped (--keep-data)")
+		}
+		confirm, _ := cmd.Flags().GetString("confirm")
+		if confirm == "" {
+			confirm = prompt("Type the client id to confirm: ")
+		}
+		if confirm != clientId {
+			log.Fatalf("Confirmation %q doesn't match client id %s, aborting", confirm, clientId)
+		}
+
+		// Teardown applications, the client is kept in the registry if one of them fails
+		entry := newAuditEntry(cmd)
+		if len(specs) > 0 {
+			deployer := newDeployer(false)
+			var deployments []*deploy.Deployment
+			for _, spec := range specs {
+				launched := deployer.Launch([]string{clientId}, spec)
+				deployer.Wait(launched, false)
+				auditPipelines(entry, spec, launched)
+				deployments = append(deployments, launched...)
+			}
+			if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+				saveAudit(entry)
+				log.Fatalf("%d/%d teardown(s) did not succeed, client %s is kept in %s", failed, len(deployments), clientId, reg.Path)
+			}
+		}
+
+		if err := reg.Remove(clientId, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+		if err := saveRegistry(reg, "Delete client "+clientId, commit); err != nil {
+			log.Fatal(err)
+		}
+		saveAudit(entry)
+		log.Infof("Client %s deleted", clientId)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(deleteCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// deleteCmd.PersistentFlags().String("foo", "", "A help for foo")
+	deleteCmd.Flags().Bool("keep-data", false, "skip data teardown jobs (delete_data_jobs)")
+	deleteCmd.Flags().String("confirm", "", "client id, to confirm deletion without being prompted")
+	deleteCmd.Flags().Bool("commit", false, "commit the clients file change to the deploy repository")
+	deleteCmd.Flags().String("ref", "", "branch or tag pipelines are triggered on (default master)")
+	addLockFlags(deleteCmd)
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// deleteCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+// prompt asks a question on the terminal and returns the answer
+func prompt(question string) string {
+	fmt.Print(question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return ""
+	}
+	return strings.TrimSpace(answer)
 }
@@ -1,17 +1,22 @@
 package cmd
 
 import (
-	"bufio"
+	"fmt"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"github.com/xanzy/go-gitlab"
 	"os"
-	"regexp"
-	"strconv"
+	"os/signal"
 	"strings"
+	"sync"
+	"time"
 )
 
+// defaultRunDir is the directory where run states are saved when run_dir isn't set
+const defaultRunDir = "deploy-runs"
+
 var s string
 
 type Pipelines struct {
@@ -20,148 +25,276 @@ type Pipelines struct {
 
 // deployCmd represents the deploy command
 var deployCmd = &cobra.Command{
-	Use:   "deploy <client id|all> [app name]",
+	Use:   "deploy <client id|pattern|all> [app name]",
 	Short: "Deploy client ID applications and application (optional)",
-	Args: cobra.RangeArgs(1, 2),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if resume, _ := cmd.Flags().GetString("resume"); resume != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("--resume deploys the clients of the run, client id and app name can't be given")
+			}
+			return nil
+		}
+		return cobra.RangeArgs(1, 2)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		clientFileName := "clients.csv"
-
+		if resume, _ := cmd.Flags().GetString("resume"); resume != "" {
+			resumeDeploy(cmd, resume)
+			return
+		}
 		// var pipelineId int
 		log.Infof("Deploying %s requested", args[0])
 
 		// Check client/app exist and establish connection
-		deployClients := checkClientAndAppExist(clientFileName, args)
-		git := gitlabConnection()
-
-		// Make pipeline + get jobs + run desired job
-		for _, clientName := range deployClients {
-			args[0] = clientName
-			pipelineId := gitlabBuildPipeline(git, args)
-			jobs := gitlabGetJob(git, pipelineId)
-			gitlabRunJob(git, pipelineId, jobs, "deploy", args)
+		reg := loadRegistry()
+		deployClients := checkClientAndAppExist(cmd, reg, args)
+
+		spec, err := newDeploySpec(cmd, reg, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Split clients in waves, then make pipeline + get jobs + run desired job for each wave
+		opts := deploy.WaveOptions{
+			BatchSize:   viper.GetInt("deploy_batch_size"),
+			MaxFailures: viper.GetInt("deploy_max_failures"),
+		}
+		opts.Canary, _ = cmd.Flags().GetStringSlice("canary")
+		opts.CanaryPercent, _ = cmd.Flags().GetInt("canary-percent")
+		waves, err := deploy.PlanWaves(deployClients, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Only show what would be done
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			output, _ := cmd.Flags().GetString("output")
+			if err := deploy.PrintPlan(os.Stdout, deploy.Plan(waves, spec, projectLabel()), output); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		unlock := acquireLocks(cmd, deployClients, "deploy "+strings.Join(args, " "))
+		follow, _ := cmd.Flags().GetBool("follow")
+		deployer := newDeployer(follow)
+		entry := newAuditEntry(cmd)
+		run := deploy.NewRun(runDir(), spec, waves, opts)
+		run.Operator, run.Command = entry.Operator, entry.Command
+		if err := run.Save(); err != nil {
+			log.Fatalf("Wasn't able to write run state %s: %s", run.Path(), err)
+		}
+		log.Infof("Starting run %s, if interrupted resume it with: deploy --resume %s", run.Id, run.Id)
+		recorder := &runRecorder{run: run}
+		deployer.OnUpdate = recorder.update
+		endAudit := startRunAudit(entry, run, recorder)
+
+		stop := cancelOnInterrupt(deployer)
+		deployments := deployer.DeployWaves(waves, spec, opts)
+		stop()
+		endAudit()
+		unlock()
+		auditPipelines(entry, spec, deployments)
+		saveAudit(entry)
+
+		// Report the final state of every client
+		if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+			log.Fatalf("%d/%d deployment(s) did not succeed, deploy them again with: deploy --resume %s", failed, len(deployments), run.Id)
 		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(deployCmd)
+
+	deployCmd.Flags().Duration("timeout", 30*time.Minute, "maximum time to wait for deploy jobs to end")
+	deployCmd.Flags().Duration("poll-interval", 5*time.Second, "delay between two job status checks")
+	viper.BindPFlag("deploy_timeout", deployCmd.Flags().Lookup("timeout"))
+	viper.BindPFlag("deploy_poll_interval", deployCmd.Flags().Lookup("poll-interval"))
+	deployCmd.Flags().Duration("jobs-timeout", time.Minute, "maximum time to wait for jobs to appear in a new pipeline")
+	viper.BindPFlag("deploy_jobs_timeout", deployCmd.Flags().Lookup("jobs-timeout"))
+	deployCmd.Flags().BoolP("follow", "f", false, "print job traces while they are running")
+	deployCmd.Flags().IntP("parallel", "p", 1, "number of clients deployed at the same time")
+	viper.BindPFlag("deploy_parallel", deployCmd.Flags().Lookup("parallel"))
+	deployCmd.Flags().StringSlice("canary", nil, "clients deployed first, the others are deployed only if they all succeed")
+	deployCmd.Flags().Int("canary-percent", 0, "percentage of clients deployed first as canary")
+	deployCmd.Flags().Int("batch-size", 0, "number of clients per wave after the canary (default all remaining clients)")
+	deployCmd.Flags().Int("max-failures", 0, "failed clients tolerated in a wave before halting deployment")
+	viper.BindPFlag("deploy_batch_size", deployCmd.Flags().Lookup("batch-size"))
+	viper.BindPFlag("deploy_max_failures", deployCmd.Flags().Lookup("max-failures"))
+	deployCmd.Flags().String("ref", "", "branch or tag pipelines are triggered on (default master)")
+	deployCmd.Flags().StringArray("var", nil, "extra pipeline variable as KEY=VALUE, can be repeated")
+	deployCmd.Flags().StringSlice("job", nil, "manual job(s) to play in the pipeline (default deploy)")
+	deployCmd.Flags().Bool("dry-run", false, "show pipelines which would be triggered without calling GitLab")
+	deployCmd.Flags().StringP("output", "o", "table", "dry run output format (table or json)")
+	deployCmd.Flags().String("resume", "", "id of an interrupted run to resume, instead of client id and app name")
+	addSelectorFlags(deployCmd)
+	addLockFlags(deployCmd)
 }
 
-func checkClientAndAppExist(clientFileName string, args []string) []string {
+// resumeDeploy continues an interrupted run: clients which succeeded are skipped, triggered pipelines are resumed and
+// the other clients are deployed again with the settings of the run
+func resumeDeploy(cmd *cobra.Command, id string) {
+	run, err := deploy.LoadRun(runDir(), id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Resuming run %s of %s started by %s: %s", run.Id, run.Time.Local().Format("2006-01-02 15:04:05"), run.Operator, run.Command)
 	var clients []string
-	clientFound := 0
-	clientId := args[0]
-	app := ""
-	if len(args) == 2 {
-		app = args[1]
+	for _, c := range run.Clients {
+		clients = append(clients, c.Client)
 	}
+	unlock := acquireLocks(cmd, clients, "deploy --resume "+run.Id)
 
-	// read csv line by line
-	inFile, _ := os.Open(clientFileName)
-	defer inFile.Close()
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
-
-	for scanner.Scan() {
-		// select clientId line
-		if strings.Contains(scanner.Text(), clientId) || clientId == "all" {
-			clientFound = 1
-			// select app line
-			if strings.Contains(scanner.Text(), app) {
-				csvLine := strings.Split(scanner.Text(), ",")
-				if match, _ := regexp.MatchString("^#", csvLine[0]) ; ! match {
-					clients = append(clients, csvLine[0])
-				}
-				log.Debugf("App %s found for client id %s: %s", app, clientId, scanner.Text())
-			}
-		}
-	}
+	follow, _ := cmd.Flags().GetBool("follow")
+	deployer := newDeployer(follow)
+	entry := newAuditEntry(cmd)
+	recorder := &runRecorder{run: run}
+	deployer.OnUpdate = recorder.update
+	endAudit := startRunAudit(entry, run, recorder)
 
-	if clientFound == 0 {
-		log.Fatalf("Client %s has not been found in %s", clientId, clientFileName)
-	}
-	if app != "" && len(clients) == 0 {
-		if clientId == "all" {
-			log.Fatal("No application has been found")
-		} else {
-			log.Fatalf("Application %s is not set for the client %s in %s", app, clientId, clientFileName)
+	stop := cancelOnInterrupt(deployer)
+	deployments := deployer.Resume(run)
+	stop()
+	endAudit()
+	unlock()
+	var resumed []*deploy.Deployment
+	for _, d := range deployments {
+		if recorder.changed(d.Client) {
+			resumed = append(resumed, d)
 		}
 	}
+	auditPipelines(entry, run.Spec, resumed)
+	saveAudit(entry)
 
-	return clients
+	if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+		log.Fatalf("%d/%d deployment(s) did not succeed, deploy them again with: deploy --resume %s", failed, len(deployments), run.Id)
+	}
 }
 
-// gitlabConnection establish a gitlab connection
-func gitlabConnection() *gitlab.Client {
-	return gitlab.NewClient(nil, viper.GetString("gitlab_private_token"))
+// runRecorder saves the state of a run when its deployments change and records the clients which changed
+type runRecorder struct {
+	run *deploy.Run
+
+	mu      sync.Mutex
+	updated map[string]bool
 }
 
-// gitlabBuildPipeline generate a pipeline from what has been configured in .gitlab-ci.yaml.
-// All jobs for this pipeline will be generated
-// Example: pipeline_id=$(curl -X POST -F "ref=deployer" -F "variables[client_id]=${client_id}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/trigger/pipeline?token=${gitlab_token}" | jq --raw-input '.id')
-func gitlabBuildPipeline(git *gitlab.Client, args []string) int {
-	// Add forms to pipeline trigger
-	customForms := make(map[string]string)
-	customForms["client_id"] = args[0]
-	if len(args) >= 2 {
-		customForms["app_name"] = args[1]
+// update is the deployer OnUpdate function, failing to save the run state doesn't stop the deployment
+func (r *runRecorder) update(d *deploy.Deployment) {
+	r.mu.Lock()
+	if r.updated == nil {
+		r.updated = make(map[string]bool)
 	}
-
-	// Generate pipeline trigger
-	opt := &gitlab.RunPipelineTriggerOptions{
-		Token:		gitlab.String(viper.GetString("gitlab_pipeline_token")),
-		Variables:	customForms,
-		Ref: 		gitlab.String("master"), // todo: remove when going to prod
+	r.updated[d.Client] = true
+	r.mu.Unlock()
+	if err := r.run.Update(d); err != nil {
+		log.Errorf("Wasn't able to save state of run %s: %s", r.run.Id, err)
 	}
+}
 
-	// Build pipeline
-	project, _, err := git.PipelineTriggers.RunPipelineTrigger(
-		viper.GetInt("gitlab_project_id"),
-		opt)
-	if err != nil {
-		log.Fatalf("Wasn't able to create the gitlab pipeline: %s", err)
-	}
+// changed tells if the deployment of a client changed
+func (r *runRecorder) changed(clientName string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updated[clientName]
+}
 
-	return project.ID
+// deployments returns the saved state of the deployments which changed
+func (r *runRecorder) deployments() []*deploy.Deployment {
+	var deployments []*deploy.Deployment
+	for _, d := range r.run.Deployments() {
+		if r.changed(d.Client) {
+			deployments = append(deployments, d)
+		}
+	}
+	return deployments
 }
 
-// gitlabGetJobId get jobs from a pipeline ID
-// Example: job_id=$(curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/pipelines/${pipeline_id}/jobs" | jq --raw-input ".[] | select(.name == 'add-client') | .id")
-func gitlabGetJob(git *gitlab.Client, pipelineId int) []*gitlab.Job {
-	jobs, _, err := git.Jobs.ListPipelineJobs(
-		viper.GetInt("gitlab_project_id"),
-		pipelineId, &gitlab.ListJobsOptions{})
-	if err != nil {
-		log.Fatalf("Wasn't able to list jobs from gitlab pipeline: %s", err)
+// atFatal runs handler if the command exits with log.Fatal, until the returned function is called
+func atFatal(handler func()) func() {
+	var mu sync.Mutex
+	active := true
+	log.RegisterExitHandler(func() {
+		mu.Lock()
+		run := active
+		active = false
+		mu.Unlock()
+		if run {
+			handler()
+		}
+	})
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		active = false
 	}
-	return jobs
 }
 
-// gitlabRunJob plays a job from a job name
-// Example: curl -X POST --header "PRIVATE-TOKEN: ${gitlab_token}" -F ref=deployer "https://gitlab.com/api/v4/projects/${gitlab_project_id}/jobs/${job_id}/play"
-func gitlabRunJob(git *gitlab.Client, pipelineId int, jobs []*gitlab.Job, jobName string, args []string) {
-	var jobId int
+// runDir returns the directory where run states are saved
+func runDir() string {
+	return firstString(viper.GetString("run_dir"), defaultRunDir)
+}
 
-	// Get pipeline ID and job ID
-	for job := range jobs {
-		if jobs[job].Name == jobName {
-			jobId = jobs[job].ID
+// cancelOnInterrupt handles Ctrl-C while deploying: no more client is launched and the operator is asked whether
+// in-flight pipelines have to be canceled, a second Ctrl-C exits at once. The returned function stops handling it
+func cancelOnInterrupt(deployer *deploy.Deployer) func() {
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-interrupts:
+		case <-done:
+			return
+		}
+		deployer.Stop()
+		log.Warn("Interrupted, no more client will be launched (Ctrl-C again to exit without waiting)")
+		go func() {
+			select {
+			case <-interrupts:
+				log.Fatal("Interrupted again, launched jobs are left running")
+			case <-done:
+			}
+		}()
+
+		if running := deployer.Running(); running > 0 {
+			answer := prompt(fmt.Sprintf("Cancel %d in-flight pipeline(s)? [y/N] ", running))
+			if answer == "y" || answer == "yes" {
+				deployer.CancelRunning()
+			}
 		}
+	}()
+
+	return func() {
+		signal.Stop(interrupts)
+		close(done)
+	}
+}
+
+// checkClientAndAppExist returns ids of the selected clients (see selectClients),
+// restricted to those having the requested app
+func checkClientAndAppExist(cmd *cobra.Command, reg *registry.Registry, args []string) []string {
+	var clients []string
+	app := ""
+	if len(args) == 2 {
+		app = args[1]
 	}
 
-	// Play job
-	_, _, err := git.Jobs.PlayJob(
-		viper.GetInt("gitlab_project_id"),
-		jobId,
-		nil,
-	)
+	selected, err := selectClients(cmd, reg, args[0])
 	if err != nil {
-		log.Fatalf("Wasn't able to play job %s id %s on pipeline %s: %s", jobName, strconv.Itoa(jobId), strconv.Itoa(pipelineId), err)
+		log.Fatal(err)
 	}
-	if len(args) == 2 {
-		log.Infof("Job successfully been launched (%s/%s)", args[0], args[1])
-	} else {
-		log.Infof("Job successfully been launched (%s)", args[0])
+	for _, client := range selected {
+		if app == "" || client.HasApp(app) {
+			log.Debugf("Client %s found in %s line %d", client.Id, reg.Path, client.Line)
+			clients = append(clients, client.Id)
+		} else if client.Id == args[0] {
+			log.Fatalf("Application %s is not set for the client %s in %s", app, client.Id, reg.Path)
+		}
+	}
+	if len(clients) == 0 {
+		log.Fatalf("Application %s is not set for any selected client in %s", app, reg.Path)
 	}
-	log.Infof("Job progression: https://gitlab.com/%s/-/jobs/%s", viper.GetString("gitlab_project_name"), strconv.Itoa(jobId))
-}
\ No newline at end of file
+
+	return clients
+}
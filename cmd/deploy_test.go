@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/xanzy/go-gitlab"
+)
+
+// deployerArgsEnv makes the test binary run the deployer with these arguments instead of the tests
+const deployerArgsEnv = "DEPLOYER_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(deployerArgsEnv); args != "" {
+		os.Args = append([]string{"deployer"}, strings.Fields(args)...)
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runDeployer runs the deployer in dir, it returns its output and whether it succeeded
+func runDeployer(t *testing.T, dir string, args ...string) (string, bool) {
+	t.Helper()
+	command := exec.Command(os.Args[0], "-test.run=^$")
+	command.Dir = dir
+	command.Env = append(os.Environ(), deployerArgsEnv+"="+strings.Join(args, " "))
+	output, err := command.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		t.Fatal(err)
+	}
+	return string(output), err == nil
+}
+
+// deployProject serves the pipeline of a GitLab project with a manual deploy job. Once played, the job ends with
+// jobStatus, or keeps running when empty, and the pipeline has pipelineStatus. The returned channel tells when the
+// job has been played
+func deployProject(t *testing.T, jobStatus string, pipelineStatus string) (*httptest.Server, <-chan bool) {
+	job := &gitlab.Job{ID: 2, Name: "deploy", Status: backend.StatusManual}
+	played := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reply interface{}
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/") {
+		case "POST trigger/pipeline":
+			reply = &gitlab.Pipeline{ID: 1, Status: backend.StatusPending}
+		case "GET pipelines/1":
+			reply = &gitlab.Pipeline{ID: 1, Status: pipelineStatus}
+		case "GET pipelines/1/jobs":
+			reply = []*gitlab.Job{job}
+		case "POST jobs/2/play":
+			job.Status = backend.StatusRunning
+			played <- true
+			reply = job
+		case "GET jobs/2":
+			if jobStatus != "" {
+				job.Status = jobStatus
+			}
+			reply = job
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	}))
+	t.Cleanup(server.Close)
+	return server, played
+}
+
+// deployerDir returns a directory with a deployer configuration using the GitLab API at url and a clients file
+func deployerDir(t *testing.T, url string) string {
+	dir := t.TempDir()
+	config := fmt.Sprintf(`gitlab_url: %s/api/v4
+gitlab_project_id: 1
+gitlab_token: token
+gitlab_pipeline_token: token
+gitlab_private_token: token
+operator: tester
+deploy_poll_interval: 1ms
+`, url)
+	for name, content := range map[string]string{".deployer.yaml": config, "clients.csv": "client_id,apps\nacme,api\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDeployExitStatus(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		jobStatus      string
+		pipelineStatus string
+		status         string
+		succeeds       bool
+		audited        string
+	}{
+		{"success", backend.StatusSuccess, backend.StatusSuccess, backend.StatusSuccess, true, audit.StatusSucceeded},
+		{"failed", backend.StatusFailed, backend.StatusFailed, backend.StatusFailed, false, audit.StatusFailed},
+		{"canceled", "", backend.StatusCanceled, backend.StatusCanceled, false, audit.StatusFailed},
+		{"timeout", "", backend.StatusRunning, deploy.StatusTimeout, false, audit.StatusFailed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := deployProject(t, test.jobStatus, test.pipelineStatus)
+			dir := deployerDir(t, server.URL)
+
+			output, succeeded := runDeployer(t, dir, "deploy", "acme", "api", "--timeout", "100ms")
+
+			if succeeded != test.succeeds {
+				t.Errorf("expected deploy to succeed: %t, got %t:\n%s", test.succeeds, succeeded, output)
+			}
+			if !strings.Contains(output, "acme    1         2    "+test.status) {
+				t.Errorf("expected status %s of acme in the summary:\n%s", test.status, output)
+			}
+			entry := readAuditEntry(t, dir)
+			if entry.Status != test.audited || len(entry.Pipelines) != 1 || entry.Pipelines[0].Status != test.status {
+				t.Errorf("expected an audit entry %s with a %s pipeline, got %s with %d pipeline(s)", test.audited, test.status, entry.Status, len(entry.Pipelines))
+			}
+		})
+	}
+}
+
+// readAuditEntry returns the only entry of the audit log in dir
+func readAuditEntry(t *testing.T, dir string) *audit.Entry {
+	t.Helper()
+	entries, err := audit.Read(filepath.Join(dir, defaultAuditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	return entries[0]
+}
+
+func TestDeployInterruptedIsAudited(t *testing.T) {
+	server, played := deployProject(t, "", backend.StatusRunning)
+	dir := deployerDir(t, server.URL)
+	command := exec.Command(os.Args[0], "-test.run=^$")
+	command.Dir = dir
+	command.Env = append(os.Environ(), deployerArgsEnv+"=deploy acme api --timeout 1m")
+	if err := command.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer command.Process.Kill()
+
+	select {
+	case <-played:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the deploy job hasn't been played")
+	}
+	entry := readAuditEntry(t, dir)
+	if entry.Status != audit.StatusStarted || len(entry.Pipelines) != 1 || entry.Pipelines[0].Client != "acme" {
+		t.Errorf("expected a started audit entry deploying acme, got %s with %d pipeline(s)", entry.Status, len(entry.Pipelines))
+	}
+
+	// The first Ctrl-C asks whether to cancel the pipeline, the second one exits at once
+	command.Process.Signal(syscall.SIGINT)
+	time.Sleep(200 * time.Millisecond)
+	command.Process.Signal(syscall.SIGINT)
+	if err := command.Wait(); err == nil {
+		t.Error("expected the interrupted deploy to fail")
+	}
+
+	entry = readAuditEntry(t, dir)
+	if entry.Status != audit.StatusInterrupted || len(entry.Pipelines) != 1 || entry.Pipelines[0].PipelineId != 1 || entry.Pipelines[0].Jobs[0].Id != 2 {
+		t.Errorf("expected an interrupted audit entry with the triggered pipeline, got %+v", entry)
+	}
+}
@@ -1,30 +1,48 @@
 package cmd
 
 import (
-	"fmt"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 // disableCmd represents the disable command
 var disableCmd = &cobra.Command{
-	Use:   "disable",
-	Short: "Disable Ingress client (not implemented)",
+	Use:   "disable <client id|pattern|all>",
+	Short: "Disable Ingress client",
+	Long: `Disable public traffic of clients (maintenance mode) by triggering the ingress job (ingress_job setting,
+ingress by default) with ingress_state=disabled. The reason and the re-enable time are recorded in the clients file
+and given to the job as ingress_reason and ingress_until variables. Clients aren't re-enabled at the until time by
+the deployer itself: enable --expired has to be scheduled (e.g. a GitLab pipeline schedule), unless the ingress job
+handles ingress_until`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("disable called")
+		reason, _ := cmd.Flags().GetString("reason")
+		untilFlag, _ := cmd.Flags().GetString("until")
+		until, err := parseUntil(untilFlag, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Disabling ingress of %s requested", args[0])
+
+		reg := loadRegistry()
+		clients, err := selectClients(cmd, reg, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		setIngress(cmd, reg, clients, ingressDisabled, reason, until)
+		if until != "" {
+			log.Infof("Clients will be re-enabled by the first enable --expired run after %s, it has to be scheduled", until)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(disableCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// disableCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// disableCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	addIngressFlags(disableCmd)
+	disableCmd.Flags().String("reason", "", "why the client is disabled")
+	disableCmd.Flags().String("until", "", "time after which enable --expired re-enables the client, as a duration (2h) or a RFC3339 date")
 }
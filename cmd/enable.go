@@ -1,30 +1,57 @@
 package cmd
 
 import (
-	"fmt"
+	"time"
 
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 // enableCmd represents the enable command
 var enableCmd = &cobra.Command{
-	Use:   "enable",
-	Short: "Enable client Ingress (not implemented)",
+	Use:   "enable <client id|pattern|all>",
+	Short: "Enable client Ingress",
+	Long: `Enable public traffic of clients by triggering the ingress job (ingress_job setting, ingress by default)
+with ingress_state=enabled. With --expired, clients whose disable time is over are re-enabled`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("enable called")
+		expired, _ := cmd.Flags().GetBool("expired")
+		if len(args) == 0 && !expired {
+			log.Fatal("A client id or all is required, unless --expired is set")
+		}
+		target := registry.All
+		if len(args) == 1 {
+			target = args[0]
+		}
+		log.Infof("Enabling ingress of %s requested", target)
+
+		reg := loadRegistry()
+		clients, err := selectClients(cmd, reg, target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if expired {
+			var toEnable []*registry.Client
+			for _, client := range clients {
+				if ingressExpired(client, time.Now()) {
+					toEnable = append(toEnable, client)
+				}
+			}
+			if len(toEnable) == 0 {
+				log.Info("No client has to be re-enabled")
+				return
+			}
+			clients = toEnable
+		}
+
+		setIngress(cmd, reg, clients, ingressEnabled, "", "")
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(enableCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// enableCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// enableCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	addIngressFlags(enableCmd)
+	enableCmd.Flags().Bool("expired", false, "only re-enable clients whose disable time is over")
 }
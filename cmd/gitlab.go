@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xanzy/go-gitlab"
+)
+
+// defaultGitlabURL is used when gitlab_url isn't set
+const defaultGitlabURL = "https://gitlab.com/"
+
+func init() {
+	viper.SetDefault("gitlab_url", defaultGitlabURL)
+	viper.SetDefault("gitlab_timeout", 30*time.Second)
+	viper.SetDefault("gitlab_max_retries", 5)
+	viper.SetDefault("gitlab_retry_min_backoff", time.Second)
+	viper.SetDefault("gitlab_retry_max_backoff", 30*time.Second)
+}
+
+// newBackend returns the GitLab backend of the configured deploy project
+func newBackend() *backend.Gitlab {
+	return backend.NewGitlab(
+		gitlabConnection(),
+		viper.GetInt("gitlab_project_id"),
+		viper.GetString("gitlab_pipeline_token"),
+		gitlabWebURL(viper.GetString("gitlab_project_name")),
+	)
+}
+
+// newDeployer returns a deployer on the GitLab backend, configured from deploy_* settings
+func newDeployer(follow bool) *deploy.Deployer {
+	return deploy.New(newBackend(), deploy.Options{
+		Parallel:     viper.GetInt("deploy_parallel"),
+		Timeout:      viper.GetDuration("deploy_timeout"),
+		JobsTimeout:  viper.GetDuration("deploy_jobs_timeout"),
+		PollInterval: viper.GetDuration("deploy_poll_interval"),
+		Follow:       follow,
+	})
+}
+
+// projectLabel returns the name and id of the deploy project
+func projectLabel() string {
+	project := viper.GetString("gitlab_project_id")
+	if name := viper.GetString("gitlab_project_name"); name != "" {
+		project = name + " (" + project + ")"
+	}
+	return project
+}
+
+// gitlabConnection establish a gitlab connection, using the configured instance, TLS and proxy settings
+func gitlabConnection() *gitlab.Client {
+	git := gitlab.NewClient(gitlabHTTPClient(), viper.GetString("gitlab_private_token"))
+	if err := git.SetBaseURL(viper.GetString("gitlab_url")); err != nil {
+		log.Fatalf("Invalid gitlab_url %s: %s", viper.GetString("gitlab_url"), err)
+	}
+	log.Debugf("Using GitLab API: %s", git.BaseURL())
+	return git
+}
+
+// gitlabHTTPClient makes the HTTP client used to reach GitLab: requests are rate limited and retried on transient
+// errors, each attempt being sent with the configured timeout, TLS and proxy settings
+func gitlabHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: backend.NewRetryTransport(gitlabAttemptClient(), backend.RetryOptions{
+			MaxRetries:        viper.GetInt("gitlab_max_retries"),
+			MinBackoff:        viper.GetDuration("gitlab_retry_min_backoff"),
+			MaxBackoff:        viper.GetDuration("gitlab_retry_max_backoff"),
+			RequestsPerSecond: viper.GetFloat64("gitlab_rate_limit"),
+			Burst:             viper.GetInt("gitlab_rate_burst"),
+		}),
+	}
+}
+
+// gitlabAttemptClient makes the HTTP client sending each attempt of a request to GitLab
+func gitlabAttemptClient() *http.Client {
+	tlsConfig := &tls.Config{}
+
+	// Custom CA bundle
+	if caFile := viper.GetString("gitlab_ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Wasn't able to read CA file %s: %s", caFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No valid certificate found in CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Client certificate
+	certFile, keyFile := viper.GetString("gitlab_client_cert"), viper.GetString("gitlab_client_key")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Wasn't able to load client certificate %s (key %s): %s", certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if viper.GetBool("gitlab_insecure_skip_verify") {
+		log.Warn("!!! TLS certificate verification of GitLab is DISABLED (gitlab_insecure_skip_verify), " +
+			"connections can be intercepted. Never use this in production !!!")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	// Proxy, from the environment (HTTPS_PROXY, NO_PROXY...) unless configured
+	proxy := http.ProxyFromEnvironment
+	if proxyURL := viper.GetString("gitlab_proxy"); proxyURL != "" {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil {
+			log.Fatalf("Invalid gitlab_proxy %s: %s", proxyURL, err)
+		}
+		proxy = http.ProxyURL(parsed)
+	}
+
+	return &http.Client{
+		Timeout: viper.GetDuration("gitlab_timeout"),
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 10,
+		},
+	}
+}
+
+// gitlabWebURL returns the web URL of a page on the configured GitLab instance
+func gitlabWebURL(parts ...string) string {
+	base := strings.TrimSuffix(viper.GetString("gitlab_url"), "/")
+	base = strings.TrimSuffix(base, "/api/v4")
+	return base + "/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show pipelines triggered by the deployer, from the audit log",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		now := time.Now()
+		filter := &audit.Filter{
+			Client: flagString(cmd, "client"),
+			App:    flagString(cmd, "app"),
+			Action: flagString(cmd, "action"),
+			Status: flagString(cmd, "status"),
+		}
+		var err error
+		if filter.Since, err = parseHistoryTime(flagString(cmd, "since"), now); err != nil {
+			log.Fatal(err)
+		}
+		if filter.Until, err = parseHistoryTime(flagString(cmd, "until"), now); err != nil {
+			log.Fatal(err)
+		}
+
+		entries, err := audit.Read(auditLog())
+		if err != nil {
+			log.Fatalf("Wasn't able to read audit log %s: %s", auditLog(), err)
+		}
+
+		// Keep matching pipelines of each entry, the most recent ones when limited
+		var matching []*audit.Entry
+		for _, entry := range entries {
+			selected := *entry
+			selected.Pipelines = nil
+			for _, pipeline := range entry.Pipelines {
+				if filter.Match(entry, pipeline) {
+					selected.Pipelines = append(selected.Pipelines, pipeline)
+				}
+			}
+			if len(selected.Pipelines) > 0 {
+				matching = append(matching, &selected)
+			}
+		}
+		if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 && len(matching) > limit {
+			matching = matching[len(matching)-limit:]
+		}
+
+		if output := flagString(cmd, "output"); output == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(matching); err != nil {
+				log.Fatal(err)
+			}
+			return
+		} else if output != "table" {
+			log.Fatalf("Unknown output format %q, expected table or json", output)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tOPERATOR\tACTION\tCLIENT\tAPP\tREF\tPIPELINE\tJOBS\tSTATUS")
+		for _, entry := range matching {
+			for _, p := range entry.Pipelines {
+				var jobs []string
+				for _, job := range p.Jobs {
+					jobs = append(jobs, job.Name)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Operator,
+					entry.Action, p.Client, firstString(p.App, "-"), p.Ref, deploy.IdOrDash(p.PipelineId), strings.Join(jobs, ","), firstString(p.Status, "-"))
+			}
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+
+	historyCmd.Flags().String("client", "", "only pipelines of this client")
+	historyCmd.Flags().String("app", "", "only pipelines of this application")
+	historyCmd.Flags().String("action", "", "only this command (deploy, enable, disable, create, delete)")
+	historyCmd.Flags().String("status", "", "only pipelines with this status (success, failed, canceled, timeout, error, halted)")
+	historyCmd.Flags().String("since", "", "only entries after this time, as a duration ago (24h) or a RFC3339 date")
+	historyCmd.Flags().String("until", "", "only entries before this time, as a duration ago (24h) or a RFC3339 date")
+	historyCmd.Flags().IntP("limit", "n", 0, "only the most recent entries")
+	historyCmd.Flags().StringP("output", "o", "table", "output format (table or json)")
+}
+
+// parseHistoryTime reads a time given as a duration before now (24h) or as a RFC3339 date
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a duration (24h) or a RFC3339 date", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	ingressEnabled  = "enabled"
+	ingressDisabled = "disabled"
+
+	// Clients file columns recording the ingress state
+	columnIngress       = "ingress"
+	columnIngressReason = "ingress_reason"
+	columnIngressUntil  = "ingress_until"
+
+	// defaultIngressJobName is the job toggling ingress when ingress_job isn't set
+	defaultIngressJobName = "ingress"
+)
+
+// ingressCmd represents the ingress command
+var ingressCmd = &cobra.Command{
+	Use:   "ingress",
+	Short: "Client Ingress state",
+}
+
+// ingressStatusCmd represents the ingress status command
+var ingressStatusCmd = &cobra.Command{
+	Use:   "status [client id|pattern|all]",
+	Short: "Show client Ingress state",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := registry.All
+		if len(args) == 1 {
+			target = args[0]
+		}
+		clients, err := selectClients(cmd, loadRegistry(), target)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CLIENT\tINGRESS\tREASON\tUNTIL")
+		for _, client := range clients {
+			until := client.Attributes[columnIngressUntil]
+			if ingressExpired(client, time.Now()) {
+				until += " (expired)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", client.Id, ingressState(client), client.Attributes[columnIngressReason], until)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ingressCmd)
+	ingressCmd.AddCommand(ingressStatusCmd)
+	addSelectorFlags(ingressStatusCmd)
+}
+
+// ingressState returns the recorded ingress state of a client, enabled when never changed
+func ingressState(client *registry.Client) string {
+	if state := client.Attributes[columnIngress]; state != "" {
+		return state
+	}
+	return ingressEnabled
+}
+
+// ingressExpired tells if a disabled client should have been re-enabled at now
+func ingressExpired(client *registry.Client, now time.Time) bool {
+	if ingressState(client) != ingressDisabled || client.Attributes[columnIngressUntil] == "" {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, client.Attributes[columnIngressUntil])
+	return err == nil && !now.Before(until)
+}
+
+// parseUntil reads a re-enable time given as a duration from now (2h) or as a RFC3339 date
+func parseUntil(value string, now time.Time) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration).UTC().Format(time.RFC3339), nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q, expected a duration (2h) or a RFC3339 date", value)
+	}
+	return until.UTC().Format(time.RFC3339), nil
+}
+
+// setIngress triggers the ingress job of every client with the requested state, then records
+// the new state of clients for which the job succeeded
+func setIngress(cmd *cobra.Command, reg *registry.Registry, clients []*registry.Client, state string, reason string, until string) {
+	ids := make([]string, len(clients))
+	for i, client := range clients {
+		ids[i] = client.Id
+	}
+
+	spec, err := newDeploySpec(cmd, reg, []string{""})
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec.Jobs = []string{firstString(viper.GetString("ingress_job"), defaultIngressJobName)}
+	spec.Overrides["ingress_state"] = state
+	if reason != "" {
+		spec.Overrides["ingress_reason"] = reason
+	}
+	if until != "" {
+		spec.Overrides["ingress_until"] = until
+	}
+
+	unlock := acquireLocks(cmd, ids, cmd.Name()+" "+strings.Join(ids, " "))
+	defer unlock()
+
+	entry := newAuditEntry(cmd)
+	deployer := newDeployer(false)
+	deployments := deployer.Launch(ids, spec)
+	deployer.Wait(deployments, len(deployments) > 1)
+	auditPipelines(entry, spec, deployments)
+	saveAudit(entry)
+	failed := deploy.PrintSummary(os.Stdout, deployments)
+
+	// Record the state of clients which have been changed
+	changed := 0
+	for _, d := range deployments {
+		if !d.Succeeded() {
+			continue
+		}
+		// Columns are set in order since missing ones are appended to the header
+		for _, attribute := range [][2]string{{columnIngress, state}, {columnIngressReason, reason}, {columnIngressUntil, until}} {
+			if err := reg.Set(d.Client, attribute[0], attribute[1]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		changed++
+	}
+	if changed > 0 {
+		commit, _ := cmd.Flags().GetBool("commit")
+		if err := saveRegistry(reg, fmt.Sprintf("Set ingress %s for %d client(s)", state, changed), commit); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("Ingress of %d/%d client(s) has not been %s", failed, len(deployments), state)
+	}
+}
+
+// addIngressFlags adds flags shared by enable and disable
+func addIngressFlags(cmd *cobra.Command) {
+	addSelectorFlags(cmd)
+	cmd.Flags().Bool("commit", false, "commit the clients file change to the deploy repository")
+	cmd.Flags().String("ref", "", "branch or tag pipelines are triggered on (default master)")
+	addLockFlags(cmd)
+}
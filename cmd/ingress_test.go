@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/registry"
+)
+
+func TestParseUntil(t *testing.T) {
+	now := time.Date(2018, 9, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"2h", "2018-09-01T10:00:00Z"},
+		{"90m", "2018-09-01T09:30:00Z"},
+		{"2018-09-02T08:00:00+02:00", "2018-09-02T06:00:00Z"},
+		{"2018-09-02T08:00:00Z", "2018-09-02T08:00:00Z"},
+	} {
+		until, err := parseUntil(test.value, now)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.value, err)
+		} else if until != test.expected {
+			t.Errorf("expected %q to be %q, got %q", test.value, test.expected, until)
+		}
+	}
+
+	for _, value := range []string{"tomorrow", "2018-09-02", "2h later"} {
+		if _, err := parseUntil(value, now); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+}
+
+func TestIngressExpired(t *testing.T) {
+	now := time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		state   string
+		until   string
+		expired bool
+	}{
+		{ingressDisabled, "2018-09-01T09:00:00Z", true},
+		{ingressDisabled, "2018-09-01T10:00:00Z", true},
+		{ingressDisabled, "2018-09-01T11:00:00Z", false},
+		{ingressDisabled, "", false},
+		{ingressDisabled, "invalid", false},
+		{ingressEnabled, "2018-09-01T09:00:00Z", false},
+		{"", "2018-09-01T09:00:00Z", false},
+	} {
+		client := &registry.Client{Id: "acme", Attributes: map[string]string{columnIngress: test.state, columnIngressUntil: test.until}}
+		if expired := ingressExpired(client, now); expired != test.expired {
+			t.Errorf("expected %s until %q to be expired: %t, got %t", test.state, test.until, test.expired, expired)
+		}
+	}
+}
+
+// ingressDir returns a deployer directory playing the deploy job as ingress job, with the clients file content
+func ingressDir(t *testing.T, url string, clients string) string {
+	dir := deployerDir(t, url)
+	config, err := ioutil.ReadFile(filepath.Join(dir, ".deployer.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{".deployer.yaml": string(config) + "ingress_job: deploy\n", "clients.csv": clients} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readClients returns the clients file of dir, which has to be valid
+func readClients(t *testing.T, dir string) (string, *registry.Registry) {
+	t.Helper()
+	path := filepath.Join(dir, "clients.csv")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := registry.Load(path)
+	if err != nil {
+		t.Fatalf("expected the clients file to stay valid: %s\n%s", err, content)
+	}
+	return string(content), reg
+}
+
+func TestDisableRecordsIngress(t *testing.T) {
+	server, _ := deployProject(t, backend.StatusSuccess, backend.StatusSuccess)
+	dir := ingressDir(t, server.URL, "client_id,apps\n# deleted initech 2018-09-01T10:00:00Z: initech,api\nacme,api\nglobex,api\n")
+
+	output, succeeded := runDeployer(t, dir, "disable", "acme", "--reason", "maintenance", "--until", "2h")
+
+	if !succeeded {
+		t.Fatalf("expected disable to succeed:\n%s", output)
+	}
+	content, reg := readClients(t, dir)
+	expected := `^client_id,apps,ingress,ingress_reason,ingress_until
+# deleted initech 2018-09-01T10:00:00Z: initech,api
+acme,api,disabled,maintenance,\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ
+globex,api,,,
+$`
+	if !regexp.MustCompile(expected).MatchString(content) {
+		t.Errorf("expected the ingress columns to be added in order:\n%s", content)
+	}
+	if tombstone := reg.Tombstone("initech"); tombstone == nil || tombstone.Client == nil || !tombstone.Client.HasApp("api") {
+		t.Errorf("expected the tombstone written before the new columns to keep its content, got %+v", tombstone)
+	}
+	acme := reg.Get("acme")
+	until, err := time.Parse(time.RFC3339, acme.Attributes[columnIngressUntil])
+	if err != nil || until.Before(time.Now().Add(time.Hour)) || until.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("expected acme to be re-enabled in 2 hours, got %q", acme.Attributes[columnIngressUntil])
+	}
+}
+
+func TestEnableExpired(t *testing.T) {
+	server, played := deployProject(t, backend.StatusSuccess, backend.StatusSuccess)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	dir := ingressDir(t, server.URL, `client_id,apps,ingress,ingress_reason,ingress_until
+acme,api,disabled,maintenance,2018-09-01T10:00:00Z
+globex,api,disabled,migration,`+future+`
+initech,api,disabled,,
+`)
+
+	output, succeeded := runDeployer(t, dir, "enable", "--expired")
+
+	if !succeeded {
+		t.Fatalf("expected enable --expired to succeed:\n%s", output)
+	}
+	if len(played) != 1 {
+		t.Errorf("expected the ingress job to be played once:\n%s", output)
+	}
+	content, _ := readClients(t, dir)
+	for _, expected := range []string{"acme,api,enabled,,\n", "globex,api,disabled,migration," + future + "\n", "initech,api,disabled,,\n"} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expected %q in the clients file:\n%s", expected, content)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/lock"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	lockStoreNone = "none"
+
+	// defaultLockTTL is the time after which locks expire when lock_ttl isn't set, locks of running commands are refreshed
+	defaultLockTTL = 2 * time.Hour
+
+	// defaultLockFile is the lock file, locally and in the deploy repository, when lock_file or gitlab_lock_file isn't set
+	defaultLockFile = "deploy-locks.json"
+)
+
+func init() {
+	viper.SetDefault("lock_ttl", defaultLockTTL)
+}
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock [client id|pattern|all]",
+	Short: "Prevent other operators from deploying clients",
+	Long: `Lock clients, or every client with --global, so other operators can't deploy them until they are unlocked
+or the lock expires`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		names := lockNames(cmd, args)
+		reason, _ := cmd.Flags().GetString("reason")
+		ttl := viper.GetDuration("lock_ttl")
+		force, _ := cmd.Flags().GetBool("force")
+
+		acquired, err := lock.Acquire(requireLockStore(), names, operator(), reason, ttl, force)
+		if err != nil {
+			log.Fatalf("Wasn't able to lock: %s", err)
+		}
+		if len(acquired) == 0 {
+			log.Infof("Already locked by %s", operator())
+			return
+		}
+		for i, name := range acquired {
+			acquired[i] = lockLabel(name)
+		}
+		log.Infof("Locked %s for %s", strings.Join(acquired, ", "), ttl)
+	},
+}
+
+// unlockCmd represents the unlock command
+var unlockCmd = &cobra.Command{
+	Use:   "unlock [client id|pattern|all]",
+	Short: "Release locks on clients",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		names := lockNames(cmd, args)
+		force, _ := cmd.Flags().GetBool("force")
+
+		released, err := lock.Release(requireLockStore(), names, operator(), force)
+		if err != nil {
+			log.Fatalf("Wasn't able to unlock: %s", err)
+		}
+		if len(released) == 0 {
+			log.Info("Nothing was locked")
+		}
+		for _, l := range released {
+			log.Infof("Unlocked %s (locked by %s)", lockLabel(l.Name), l.Owner)
+		}
+	},
+}
+
+// locksCmd represents the locks command
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Manage deploy locks",
+}
+
+// locksListCmd represents the locks list command
+var locksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List locks held on clients",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		locks, err := requireLockStore().List()
+		if err != nil {
+			log.Fatalf("Wasn't able to read locks: %s", err)
+		}
+		if all, _ := cmd.Flags().GetBool("all"); !all {
+			var live []*lock.Lock
+			for _, l := range locks {
+				if l.Live(time.Now()) {
+					live = append(live, l)
+				}
+			}
+			locks = live
+		}
+		if err := printLocks(locks, flagString(cmd, "output")); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd, unlockCmd, locksCmd)
+	locksCmd.AddCommand(locksListCmd)
+
+	for _, cmd := range []*cobra.Command{lockCmd, unlockCmd} {
+		addSelectorFlags(cmd)
+		cmd.Flags().Bool("global", false, "the global lock, preventing any client to be deployed")
+	}
+	lockCmd.Flags().String("reason", "", "why clients are locked, shown to other operators")
+	lockCmd.Flags().Duration("ttl", defaultLockTTL, "time after which the lock expires (lock_ttl setting)")
+	viper.BindPFlag("lock_ttl", lockCmd.Flags().Lookup("ttl"))
+	lockCmd.Flags().Bool("force", false, "take over locks of other operators")
+	unlockCmd.Flags().Bool("force", false, "also release locks of other operators")
+	locksListCmd.Flags().Bool("all", false, "also list expired locks")
+	locksListCmd.Flags().StringP("output", "o", "table", "output format (table or json)")
+}
+
+// addLockFlags adds the flags of commands triggering pipelines for clients, which lock them first
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("force", false, "go on even if other operators locked the clients, taking over their locks")
+	cmd.Flags().Bool("global-lock", false, "also take the global lock, preventing others from deploying any client (lock_global setting)")
+}
+
+// lockNames returns the names of the locks taken or released by lock and unlock
+func lockNames(cmd *cobra.Command, args []string) []string {
+	var names []string
+	if global, _ := cmd.Flags().GetBool("global"); global {
+		names = append(names, lock.Global)
+	}
+	if len(args) == 0 {
+		if len(names) == 0 {
+			log.Fatal("Give a client id, a pattern or all, or --global")
+		}
+		return names
+	}
+	clients, err := selectClients(cmd, loadRegistry(), args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, client := range clients {
+		names = append(names, client.Id)
+	}
+	return names
+}
+
+// acquireLocks locks clients for the operator before triggering their pipelines (and every client with --global-lock),
+// it exits when other operators locked them unless --force is given. Locks are refreshed until the returned function
+// releases them, which is also done if the command exits with log.Fatal
+func acquireLocks(cmd *cobra.Command, clients []string, reason string) func() {
+	store := lockStore()
+	if store == nil {
+		return func() {}
+	}
+	names := clients
+	if global, _ := cmd.Flags().GetBool("global-lock"); global || viper.GetBool("lock_global") {
+		names = append([]string{lock.Global}, clients...)
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	owner := operator()
+	ttl := viper.GetDuration("lock_ttl")
+
+	acquired, err := lock.Acquire(store, names, owner, reason, ttl, force)
+	if _, conflict := err.(*lock.ConflictError); conflict {
+		log.Fatalf("%s. Use --force to go on anyway", err)
+	}
+	if err != nil {
+		log.Fatalf("Wasn't able to lock clients: %s", err)
+	}
+	if force {
+		log.Warn("Locks of other operators have been taken over (--force)")
+	}
+	log.Debugf("Locked %s", strings.Join(acquired, ", "))
+	if len(acquired) == 0 {
+		return func() {}
+	}
+
+	stop, stopped := make(chan bool), make(chan bool)
+	go refreshLocks(store, acquired, owner, reason, ttl, stop, stopped)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			if _, err := lock.Release(store, acquired, owner, false); err != nil {
+				log.Errorf("Wasn't able to unlock clients: %s", err)
+			}
+		})
+	}
+	done := atFatal(release)
+	return func() {
+		done()
+		release()
+	}
+}
+
+// refreshLocks extends the locks every half of their ttl until stop is closed, so they don't expire while clients are
+// being deployed. stopped is closed once it's over
+func refreshLocks(store lock.Store, names []string, owner string, reason string, ttl time.Duration, stop <-chan bool, stopped chan<- bool) {
+	defer close(stopped)
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := lock.Refresh(store, names, owner, reason, ttl); err != nil {
+				log.Warnf("Wasn't able to refresh locks: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// lockStore returns where locks are kept (lock_store setting): a local file, a file of the deploy repository,
+// or nil when locking is disabled. Locks are kept like the clients file by default
+func lockStore() lock.Store {
+	switch store := firstString(viper.GetString("lock_store"), viper.GetString("clients_source"), clientsSourceLocal); store {
+	case clientsSourceLocal:
+		return &lock.FileStore{Path: firstString(viper.GetString("lock_file"), defaultLockFile)}
+	case clientsSourceGitlab:
+		return &gitlabLockStore{path: firstString(viper.GetString("gitlab_lock_file"), defaultLockFile), branch: remoteClientsBranch()}
+	case lockStoreNone:
+		return nil
+	default:
+		log.Fatalf("Unknown lock store %q, expected %s, %s or %s", store, clientsSourceLocal, clientsSourceGitlab, lockStoreNone)
+		return nil
+	}
+}
+
+// requireLockStore returns the lock store, exiting when locking is disabled
+func requireLockStore() lock.Store {
+	store := lockStore()
+	if store == nil {
+		log.Fatalf("Locking is disabled (lock_store: %s)", lockStoreNone)
+	}
+	return store
+}
+
+// gitlabLockStore keeps locks in a file of the deploy repository. Changes are committed only if the file hasn't
+// been changed since it has been read, otherwise they are made again on the new version
+type gitlabLockStore struct {
+	path   string
+	branch string
+}
+
+// List returns every lock of the file, none when it doesn't exist
+func (s *gitlabLockStore) List() ([]*lock.Lock, error) {
+	locks, _, err := s.read()
+	return locks, err
+}
+
+// Update changes the locks and commits the file
+// Example: curl -X PUT --header "PRIVATE-TOKEN: ${gitlab_token}" -F "branch=master" -F "last_commit_id=${commit_id}" -F "content=<deploy-locks.json" -F "commit_message=Lock acme" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/repository/files/deploy-locks.json"
+func (s *gitlabLockStore) Update(message string, change func(locks []*lock.Lock) ([]*lock.Lock, error)) error {
+	git := gitlabConnection()
+	project := viper.GetInt("gitlab_project_id")
+	for attempt := 1; ; attempt++ {
+		locks, revision, err := s.read()
+		if err != nil {
+			return err
+		}
+		locks, err = change(locks)
+		if err != nil {
+			return err
+		}
+		content, err := lock.Encode(locks)
+		if err != nil {
+			return err
+		}
+
+		if revision == "" {
+			_, _, err = git.RepositoryFiles.CreateFile(project, s.path, &gitlab.CreateFileOptions{
+				Branch:        gitlab.String(s.branch),
+				Content:       gitlab.String(string(content)),
+				CommitMessage: gitlab.String(message),
+			})
+		} else {
+			_, _, err = git.RepositoryFiles.UpdateFile(project, s.path, &gitlab.UpdateFileOptions{
+				Branch:        gitlab.String(s.branch),
+				Content:       gitlab.String(string(content)),
+				CommitMessage: gitlab.String(message),
+				LastCommitID:  gitlab.String(revision),
+			})
+		}
+		if err == nil {
+			return nil
+		}
+		if !staleRevision(err) || attempt == 3 {
+			return fmt.Errorf("wasn't able to commit %s to branch %s: %s", s.path, s.branch, err)
+		}
+		log.Debugf("Wasn't able to commit %s, it has been changed meanwhile, trying again: %s", s.path, err)
+	}
+}
+
+// staleRevision tells if committing the lock file failed because it has been changed or created since it has been read
+func staleRevision(err error) bool {
+	var response *gitlab.ErrorResponse
+	if !errors.As(err, &response) {
+		return false
+	}
+	switch response.Response.StatusCode {
+	case http.StatusConflict:
+		return true
+	case http.StatusBadRequest:
+		message := strings.ToLower(response.Message)
+		return strings.Contains(message, "changed since") || strings.Contains(message, "already exists")
+	}
+	return false
+}
+
+// read returns the locks of the file and the last commit which changed it, empty when the file doesn't exist
+func (s *gitlabLockStore) read() ([]*lock.Lock, string, error) {
+	git := gitlabConnection()
+	file, resp, err := git.RepositoryFiles.GetFile(viper.GetInt("gitlab_project_id"), s.path, &gitlab.GetFileOptions{Ref: gitlab.String(s.branch)})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("wasn't able to read %s from branch %s: %s", s.path, s.branch, err)
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return nil, "", fmt.Errorf("wasn't able to decode %s: %s", s.path, err)
+	}
+	locks, err := lock.Parse(content)
+	if err != nil {
+		return nil, "", fmt.Errorf("wasn't able to read lock file %s: %s", s.path, err)
+	}
+	return locks, resp.Header.Get("X-Gitlab-Last-Commit-Id"), nil
+}
+
+// lockLabel returns the name of a lock as shown to operators
+func lockLabel(name string) string {
+	if name == lock.Global {
+		return registry.All + " (global)"
+	}
+	return name
+}
+
+// printLocks prints locks as a table or as JSON
+func printLocks(locks []*lock.Lock, format string) error {
+	switch format {
+	case "json":
+		if locks == nil {
+			locks = []*lock.Lock{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(locks)
+	case "table":
+	default:
+		return fmt.Errorf("unknown output format %q, expected table or json", format)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tOWNER\tREASON\tCREATED\tEXPIRES\tSTATE")
+	for _, l := range locks {
+		state := "live"
+		if !l.Live(now) {
+			state = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", lockLabel(l.Name), l.Owner, firstString(l.Reason, "-"),
+			l.Created.Local().Format("2006-01-02 15:04:05"), l.Expires.Local().Format("2006-01-02 15:04:05"), state)
+	}
+	return w.Flush()
+}
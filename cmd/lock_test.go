@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockRepository serves the lock file of the deploy repository, commits failing with the status codes of failures
+// in turn. A file which can't be created since it already exists is then found with the locks of another operator
+type lockRepository struct {
+	mu       sync.Mutex
+	content  string
+	failures []int
+	requests map[string]int
+}
+
+func (repo *lockRepository) serve(w http.ResponseWriter, r *http.Request) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.requests[r.Method]++
+	if r.URL.Path != "/api/v4/projects/1/repository/files/deploy-locks.json" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		if repo.content == "" {
+			http.Error(w, `{"message":"404 File Not Found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Gitlab-Last-Commit-Id", "abcd")
+		json.NewEncoder(w).Encode(map[string]string{"file_path": "deploy-locks.json", "content": base64.StdEncoding.EncodeToString([]byte(repo.content))})
+		return
+	}
+	if len(repo.failures) > 0 {
+		code := repo.failures[0]
+		repo.failures = repo.failures[1:]
+		message := "403 Forbidden"
+		if code == http.StatusBadRequest {
+			message = "A file with this name already exists"
+			repo.content = `[{"name":"globex","owner":"someone","expires":"2999-01-01T00:00:00Z"}]`
+		}
+		http.Error(w, `{"message":"`+message+`"}`, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"file_path":"deploy-locks.json","branch":"master"}`))
+}
+
+func TestGitlabLockStoreRetries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		failures []int
+		succeeds bool
+		commits  int
+	}{
+		{"stale revision", []int{http.StatusBadRequest}, true, 2},
+		{"forbidden", []int{http.StatusForbidden}, false, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			repo := &lockRepository{failures: test.failures, requests: make(map[string]int)}
+			server := httptest.NewServer(http.HandlerFunc(repo.serve))
+			defer server.Close()
+			dir := deployerDir(t, server.URL)
+			config, err := ioutil.ReadFile(filepath.Join(dir, ".deployer.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config = append(config, "lock_store: gitlab\ngitlab_max_retries: 0\n"...)
+			if err := ioutil.WriteFile(filepath.Join(dir, ".deployer.yaml"), config, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			output, succeeded := runDeployer(t, dir, "lock", "acme")
+
+			if succeeded != test.succeeds {
+				t.Errorf("expected lock to succeed: %t, got %t:\n%s", test.succeeds, succeeded, output)
+			}
+			if commits := repo.requests[http.MethodPost] + repo.requests[http.MethodPut]; commits != test.commits {
+				t.Errorf("expected %d commit(s), got %d:\n%s", test.commits, commits, output)
+			}
+			if test.succeeds && (repo.requests[http.MethodPut] != 1 || !strings.Contains(output, "Locked acme")) {
+				t.Errorf("expected the lock file to be updated on the new revision:\n%s", output)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xanzy/go-gitlab"
+)
+
+// loadRegistry reads and validates the clients file given by --clientfile, or the one of the deploy repository
+// with clients_source: gitlab
+func loadRegistry() *registry.Registry {
+	if remoteClients() {
+		reg, err := loadRemoteRegistry()
+		if err != nil {
+			log.Fatalf("Wasn't able to load clients file from the deploy repository:\n%s", err)
+		}
+		log.Debugf("Using clients file: %s of the deploy repository at commit %s (%d clients)", reg.Path, reg.Revision, len(reg.Clients))
+		return reg
+	}
+	if clientFile == "" {
+		clientFile = "clients.csv"
+	}
+	reg, err := registry.Load(clientFile)
+	if err != nil {
+		log.Fatalf("Wasn't able to load clients file %s:\n%s", clientFile, err)
+	}
+	log.Debugf("Using clients file: %s (%d clients)", clientFile, len(reg.Clients))
+	return reg
+}
+
+// saveRegistry rewrites the clients file and, when commit is set, commits it to the deploy repository.
+// Clients files read from the deploy repository are always committed
+func saveRegistry(reg *registry.Registry, message string, commit bool) error {
+	if remoteClients() {
+		defer dropRemoteCache()
+		return gitlabCommitRegistry(reg, message)
+	}
+	if err := reg.Save(); err != nil {
+		return fmt.Errorf("wasn't able to save %s: %s", reg.Path, err)
+	}
+	log.Infof("Clients file %s updated", reg.Path)
+
+	if commit {
+		return gitlabCommitRegistry(reg, message)
+	}
+	return nil
+}
+
+// gitlabCommitRegistry commits the clients file to the deploy repository (gitlab_clients_file on gitlab_clients_branch).
+// When the revision of the registry is known, the commit is refused if the file has been changed since
+// Example: curl -X PUT --header "PRIVATE-TOKEN: ${gitlab_token}" -F branch=master -F content=@clients.csv -F commit_message=... "https://gitlab.com/api/v4/projects/${gitlab_project_id}/repository/files/clients.csv"
+func gitlabCommitRegistry(reg *registry.Registry, message string) error {
+	content, err := reg.Bytes()
+	if err != nil {
+		return err
+	}
+	path, branch := remoteClientsFile(), remoteClientsBranch()
+	opts := &gitlab.UpdateFileOptions{
+		Branch:        gitlab.String(branch),
+		Content:       gitlab.String(string(content)),
+		CommitMessage: gitlab.String(message),
+	}
+	if reg.Revision != "" {
+		if err := checkRemoteConflict(path, branch, reg.Revision); err != nil {
+			return err
+		}
+		opts.LastCommitID = gitlab.String(reg.Revision)
+	}
+
+	git := gitlabConnection()
+	_, _, err = git.RepositoryFiles.UpdateFile(viper.GetInt("gitlab_project_id"), path, opts)
+	if err != nil {
+		return fmt.Errorf("wasn't able to commit %s to branch %s: %s", path, branch, err)
+	}
+	log.Infof("Clients file committed to %s on branch %s", path, branch)
+	return nil
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	clientsSourceLocal  = "local"
+	clientsSourceGitlab = "gitlab"
+)
+
+// remoteFile is the state of the clients file in the deploy repository
+type remoteFile struct {
+	BlobId       string `json:"blob_id"`
+	LastCommitId string `json:"last_commit_id"`
+}
+
+// remoteClients tells if the clients file is read from the deploy repository (clients_source: gitlab)
+func remoteClients() bool {
+	switch source := firstString(viper.GetString("clients_source"), clientsSourceLocal); source {
+	case clientsSourceLocal:
+		return false
+	case clientsSourceGitlab:
+		return true
+	default:
+		log.Fatalf("Unknown clients source %q, expected %s or %s", source, clientsSourceLocal, clientsSourceGitlab)
+		return false
+	}
+}
+
+// remoteClientsFile returns the path of the clients file in the deploy repository
+func remoteClientsFile() string {
+	if path := viper.GetString("gitlab_clients_file"); path != "" {
+		return path
+	}
+	return filepath.Base(firstString(clientFile, "clients.csv"))
+}
+
+// remoteClientsBranch returns the branch the clients file is read from and committed to
+func remoteClientsBranch() string {
+	return firstString(viper.GetString("gitlab_clients_branch"), defaultRef)
+}
+
+// remoteCachePath returns where the clients file of the deploy repository is cached
+func remoteCachePath() string {
+	dir := viper.GetString("clients_cache_dir")
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			cache = os.TempDir()
+		}
+		dir = filepath.Join(cache, "msa-deployer")
+	}
+	return filepath.Join(dir, strconv.Itoa(viper.GetInt("gitlab_project_id")), url.PathEscape(remoteClientsBranch()), url.PathEscape(remoteClientsFile()))
+}
+
+// loadRemoteRegistry reads the clients file from the deploy repository. The file is cached and only downloaded
+// again when its blob changed. The cache is used when GitLab can't be reached
+func loadRemoteRegistry() (*registry.Registry, error) {
+	path, branch := remoteClientsFile(), remoteClientsBranch()
+	name := path + "@" + branch
+	cachePath := remoteCachePath()
+	cached, cachedErr := readRemoteCache(cachePath)
+
+	current, err := gitlabRemoteFile(path, branch)
+	if err != nil {
+		if cachedErr != nil {
+			return nil, fmt.Errorf("wasn't able to read %s from the deploy repository: %s", name, err)
+		}
+		log.Warnf("Wasn't able to check %s in the deploy repository, using the cached copy of commit %s: %s", name, cached.LastCommitId, err)
+		current = cached
+	}
+
+	var content []byte
+	if cachedErr != nil || current.BlobId != cached.BlobId {
+		log.Debugf("Downloading %s (blob %s)", name, current.BlobId)
+		downloaded, file, err := gitlabDownloadFile(path, branch)
+		if err != nil {
+			return nil, err
+		}
+		content, current = downloaded, file
+		if err := writeRemoteCache(cachePath, content, current); err != nil {
+			log.Warnf("Wasn't able to cache %s: %s", name, err)
+		}
+	} else if content, err = ioutil.ReadFile(cachePath); err != nil {
+		return nil, err
+	}
+	// name is only used in messages, the format is given by the file extension
+	reg, err := registry.ReadFormat(bytes.NewReader(content), name, registry.FormatOf(path))
+	if err != nil {
+		return nil, err
+	}
+	reg.Revision = current.LastCommitId
+	return reg, nil
+}
+
+// gitlabRemoteFile returns the state of a file of the deploy repository, without downloading it
+// Example: curl --head --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/repository/files/clients.csv?ref=master"
+func gitlabRemoteFile(path string, branch string) (*remoteFile, error) {
+	git := gitlabConnection()
+	req, err := git.NewRequest("HEAD", fmt.Sprintf("projects/%d/repository/files/%s", viper.GetInt("gitlab_project_id"), url.PathEscape(path)),
+		&gitlab.GetFileOptions{Ref: gitlab.String(branch)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := git.Do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{
+		BlobId:       resp.Header.Get("X-Gitlab-Blob-Id"),
+		LastCommitId: resp.Header.Get("X-Gitlab-Last-Commit-Id"),
+	}, nil
+}
+
+// gitlabDownloadFile returns the content and state of a file of the deploy repository
+// Example: curl --header "PRIVATE-TOKEN: ${gitlab_token}" "https://gitlab.com/api/v4/projects/${gitlab_project_id}/repository/files/clients.csv?ref=master"
+func gitlabDownloadFile(path string, branch string) ([]byte, *remoteFile, error) {
+	git := gitlabConnection()
+	file, resp, err := git.RepositoryFiles.GetFile(viper.GetInt("gitlab_project_id"), path, &gitlab.GetFileOptions{Ref: gitlab.String(branch)})
+	if err != nil {
+		return nil, nil, fmt.Errorf("wasn't able to download %s from branch %s: %s", path, branch, err)
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wasn't able to decode %s: %s", path, err)
+	}
+	return content, &remoteFile{BlobId: file.BlobID, LastCommitId: resp.Header.Get("X-Gitlab-Last-Commit-Id")}, nil
+}
+
+// checkRemoteConflict ensures the clients file has not been changed in the deploy repository since revision
+func checkRemoteConflict(path string, branch string, revision string) error {
+	current, err := gitlabRemoteFile(path, branch)
+	if err != nil {
+		return fmt.Errorf("wasn't able to check %s on branch %s: %s", path, branch, err)
+	}
+	if current.LastCommitId != revision {
+		return fmt.Errorf("%s has been changed on branch %s by commit %s since it has been read (commit %s), run the command again",
+			path, branch, current.LastCommitId, revision)
+	}
+	return nil
+}
+
+func readRemoteCache(cachePath string) (*remoteFile, error) {
+	content, err := ioutil.ReadFile(cachePath + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var file remoteFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func writeRemoteCache(cachePath string, content []byte, file *remoteFile) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	state, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cachePath, content, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cachePath+".json", state, 0644)
+}
+
+// dropRemoteCache removes the cached clients file, so it's downloaded again on next read
+func dropRemoteCache() {
+	cachePath := remoteCachePath()
+	os.Remove(cachePath + ".json")
+	os.Remove(cachePath)
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// retryCmd represents the retry command
+var retryCmd = &cobra.Command{
+	Use:   "retry <client id|pattern|all> [app name]",
+	Short: "Retry failed or canceled deployments of client applications",
+	Long: `Retry the failed or canceled jobs of the last deployment of client applications, then wait for them to end.
+Deployments are looked up like status does, or only in the pipelines recorded in the audit log with --from-audit`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Infof("Retrying %s requested", args[0])
+
+		git := newBackend()
+		statuses, err := launchedPipelines(cmd, git, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var ended []*appStatus
+		for _, status := range statuses {
+			switch status.Status {
+			case backend.StatusFailed, backend.StatusCanceled:
+				ended = append(ended, status)
+			}
+		}
+		ended = pipelineStatuses(ended)
+		if len(ended) == 0 {
+			log.Info("No failed or canceled deployment found")
+			return
+		}
+		if err := printStatus(ended, "table"); err != nil {
+			log.Fatal(err)
+		}
+		if !confirmed(cmd, fmt.Sprintf("Retry %d deployment(s)? [y/N] ", len(ended))) {
+			return
+		}
+
+		var clients []string
+		seen := make(map[string]bool)
+		for _, status := range ended {
+			if !seen[status.Client] {
+				seen[status.Client] = true
+				clients = append(clients, status.Client)
+			}
+		}
+		unlock := acquireLocks(cmd, clients, "retry "+strings.Join(args, " "))
+		defer unlock()
+
+		entry := newAuditEntry(cmd)
+		follow, _ := cmd.Flags().GetBool("follow")
+		deployer := newDeployer(follow)
+		deployments := make([]*deploy.Deployment, len(ended))
+		for i, status := range ended {
+			deployments[i] = retryJobs(git, status)
+		}
+		deployer.Wait(deployments, len(deployments) > 1)
+
+		for i, status := range ended {
+			auditPipelines(entry, &deploy.Spec{App: status.App, Ref: status.Ref}, deployments[i:i+1])
+		}
+		saveAudit(entry)
+		if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+			log.Fatalf("%d/%d retried deployment(s) did not succeed", failed, len(deployments))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(retryCmd)
+
+	addSelectorFlags(retryCmd)
+	addLaunchedPipelinesFlags(retryCmd)
+	retryCmd.Flags().BoolP("follow", "f", false, "print job traces while they are running")
+	retryCmd.Flags().Bool("dry-run", false, "only show the deployments which would be retried")
+	retryCmd.Flags().BoolP("yes", "y", false, "retry without being prompted")
+	addLockFlags(retryCmd)
+}
+
+// retryJobs retries the failed or canceled jobs of a deployment, only the last run of each job is considered.
+// Jobs which can't be retried are reported in the deployment error, the retried ones are still waited for
+func retryJobs(git backend.Backend, status *appStatus) *deploy.Deployment {
+	d := &deploy.Deployment{Client: status.Client, PipelineId: status.PipelineId}
+	last := make(map[string]*audit.Job)
+	var names []string
+	for _, job := range status.Jobs {
+		if previous, ok := last[job.Name]; !ok {
+			names = append(names, job.Name)
+		} else if previous.Id > job.Id {
+			continue
+		}
+		last[job.Name] = job
+	}
+
+	var failures []string
+	retryable := true
+	for _, name := range names {
+		job := last[name]
+		if job.Status != backend.StatusFailed && job.Status != backend.StatusCanceled {
+			continue
+		}
+		retried, err := git.RetryJob(job.Id)
+		if err != nil {
+			log.Errorf("Retry of job %s (%d) of %s/%s failed: %s", job.Name, job.Id, status.Client, status.App, err)
+			failures = append(failures, fmt.Sprintf("%s (%d): %s", job.Name, job.Id, err))
+			retryable = retryable && backend.IsRetryable(err)
+			continue
+		}
+		log.Infof("Job %s of %s/%s retried as job %d", job.Name, status.Client, status.App, retried.Id)
+		d.Jobs = append(d.Jobs, &deploy.PlayedJob{Name: job.Name, Id: retried.Id})
+	}
+	switch {
+	case len(failures) > 0:
+		d.Status = deploy.StatusError
+		d.Error = fmt.Errorf("wasn't able to retry job(s) %s", strings.Join(failures, ", "))
+		d.Retryable = retryable
+	case len(d.Jobs) == 0:
+		d.Status = deploy.StatusError
+		d.Error = fmt.Errorf("no failed or canceled job to retry in pipeline %d", status.PipelineId)
+	}
+	return d
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestRetryWaitsForRetriedJobs(t *testing.T) {
+	failed := deployment(3, "acme", "api", "cccc")
+	failed.status = backend.StatusFailed
+	failed.jobs = []*gitlab.Job{
+		{ID: 30, Name: "deploy", Status: backend.StatusFailed},
+		{ID: 31, Name: "migrate", Status: backend.StatusCanceled},
+		{ID: 32, Name: "smoke", Status: backend.StatusSuccess},
+	}
+	project := newHistoryProject(t, failed)
+	project.retryErrors[31] = 403
+	dir := historyDir(t, project)
+
+	output, succeeded := runDeployer(t, dir, "retry", "acme", "api", "--yes")
+
+	if succeeded {
+		t.Errorf("expected retry to fail since migrate can't be retried:\n%s", output)
+	}
+	if project.requested("jobs/30/retry") != 1 || project.requested("jobs/31/retry") != 1 || project.requested("jobs/32/retry") != 0 {
+		t.Errorf("expected only the failed and canceled jobs to be retried:\n%s", output)
+	}
+	if project.requested("jobs/1000") == 0 {
+		t.Errorf("expected the retried deploy job to be waited for:\n%s", output)
+	}
+	if expected := `acme\s+3\s+1000\s+error\s+wasn't able to retry job\(s\) migrate \(31\)`; !regexp.MustCompile(expected).MatchString(output) {
+		t.Errorf("expected the summary to match %q:\n%s", expected, output)
+	}
+
+	entry := readAuditEntry(t, dir)
+	if len(entry.Pipelines) != 1 {
+		t.Fatalf("expected 1 audited pipeline, got %d", len(entry.Pipelines))
+	}
+	pipeline := entry.Pipelines[0]
+	if pipeline.Client != "acme" || pipeline.App != "api" || pipeline.PipelineId != 3 || pipeline.Status != deploy.StatusError {
+		t.Errorf("unexpected audited pipeline %+v", pipeline)
+	}
+	if len(pipeline.Jobs) != 1 || *pipeline.Jobs[0] != (audit.Job{Name: "deploy", Id: 1000, Status: backend.StatusSuccess}) {
+		t.Errorf("expected the retried deploy job to be audited with its status, got %+v", pipeline.Jobs)
+	}
+	if !strings.Contains(pipeline.Error, "migrate (31)") || pipeline.Retryable {
+		t.Errorf("expected the permanent failure to retry migrate to be audited, got %q (retryable: %t)", pipeline.Error, pipeline.Retryable)
+	}
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// defaultRollbackShaVariable is the variable giving the sha to deploy when rollback_sha_variable isn't set
+const defaultRollbackShaVariable = "deploy_sha"
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <client id> [app name]",
+	Short: "Redeploy the previous successful version of client applications",
+	Long: `Find the previous successful deployment of client applications (see status for how deployments are found),
+then trigger a deploy pipeline on its ref. As pipelines can only be triggered on a branch or a tag, the sha to deploy
+is given to jobs as the deploy_sha variable (rollback_sha_variable setting), jobs have to check it out`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		clientId := args[0]
+		log.Infof("Rolling back %s requested", strings.Join(args, " "))
+
+		reg := loadRegistry()
+		client := reg.Get(clientId)
+		if client == nil {
+			log.Fatalf("Client %s has not been found in %s", clientId, reg.Path)
+		}
+		apps := client.Apps
+		if len(args) == 2 {
+			if !client.HasApp(args[1]) {
+				log.Fatalf("Application %s is not set for the client %s in %s", args[1], clientId, reg.Path)
+			}
+			apps = []string{args[1]}
+		}
+
+		// Find where each application returns to
+		git := newBackend()
+		max := maxPipelines(cmd)
+		var specs []*deploy.Spec
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "APP\tCURRENT\tROLLBACK TO\tPIPELINE")
+		history, err := clientHistory(git, clientId, apps, max)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, app := range apps {
+			current, target := rollbackTarget(history[app])
+			if target == nil {
+				if len(args) == 2 {
+					log.Fatalf("No previous successful deployment of %s for client %s in the last %d pipelines", app, clientId, max)
+				}
+				log.Warnf("No previous successful deployment of %s for client %s in the last %d pipelines, skipped", app, clientId, max)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s@%s (%s)\t%s@%s\t%d\n", app, current.Ref, shortSha(current.Sha), current.Status, target.Ref, shortSha(target.Sha), target.Id)
+
+			spec, err := newDeploySpec(cmd, reg, []string{clientId, app})
+			if err != nil {
+				log.Fatal(err)
+			}
+			spec.Ref = target.Ref
+			spec.Overrides[rollbackShaVariable()] = target.Sha
+			specs = append(specs, spec)
+		}
+		w.Flush()
+		if len(specs) == 0 {
+			log.Fatalf("No application of client %s can be rolled back", clientId)
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return
+		}
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			if answer := prompt("Roll back? [y/N] "); answer != "y" && answer != "yes" {
+				log.Fatal("Rollback aborted")
+			}
+		}
+
+		unlock := acquireLocks(cmd, []string{clientId}, "rollback "+strings.Join(args, " "))
+		entry := newAuditEntry(cmd)
+		deployer := newDeployer(false)
+		var deployments []*deploy.Deployment
+		for _, spec := range specs {
+			launched := deployer.Launch([]string{clientId}, spec)
+			deployer.Wait(launched, false)
+			auditPipelines(entry, spec, launched)
+			deployments = append(deployments, launched...)
+		}
+		unlock()
+		saveAudit(entry)
+		if failed := deploy.PrintSummary(os.Stdout, deployments); failed > 0 {
+			log.Fatalf("%d/%d rollback(s) did not succeed", failed, len(deployments))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	rollbackCmd.Flags().StringSlice("job", nil, "manual job(s) to play in the pipeline (default deploy)")
+	rollbackCmd.Flags().StringArray("var", nil, "extra pipeline variable as KEY=VALUE, can be repeated")
+	rollbackCmd.Flags().Int("max-pipelines", 100, "number of recent pipelines (or environment deployments) looked up (status_max_pipelines setting)")
+	rollbackCmd.Flags().Bool("dry-run", false, "only show the versions client applications would return to")
+	rollbackCmd.Flags().BoolP("yes", "y", false, "roll back without being prompted")
+	addLockFlags(rollbackCmd)
+}
+
+// rollbackTarget returns the current deployment of an application history (most recent first) and the previous
+// successful one of another sha, nil if there is none
+func rollbackTarget(history []*backend.Pipeline) (current *backend.Pipeline, target *backend.Pipeline) {
+	if len(history) == 0 {
+		return nil, nil
+	}
+	current = history[0]
+	for _, p := range history[1:] {
+		if p.Status == backend.StatusSuccess && p.Sha != current.Sha {
+			return current, p
+		}
+	}
+	return current, nil
+}
+
+// clientHistory returns the deployments of client applications found in the last max pipelines (or environment
+// deployments with status_source: environments) by application, the most recent first. Deployments are found like
+// status does, their sha being the one they deployed. Pipelines and their variables are only fetched once for every
+// application
+func clientHistory(git *backend.Gitlab, client string, apps []string, max int) (map[string][]*backend.Pipeline, error) {
+	history := make(map[string][]*backend.Pipeline)
+	if firstString(viper.GetString("status_source"), statusSourcePipelines) == statusSourceEnvironments {
+		deployments, err := git.RecentDeployments(max)
+		if err != nil {
+			return nil, fmt.Errorf("wasn't able to list deployments: %s", err)
+		}
+		environments := make(map[string]string)
+		for _, app := range apps {
+			environments[statusEnvironment(client, app)] = app
+		}
+		for _, d := range deployments {
+			app, ok := environments[d.Environment]
+			if !ok {
+				continue
+			}
+			variables, err := git.PipelineVariables(d.Pipeline.Id)
+			if err != nil {
+				return nil, fmt.Errorf("wasn't able to get variables of pipeline %d: %s", d.Pipeline.Id, err)
+			}
+			d.Pipeline.Sha = deployedSha(d.Pipeline.Sha, variables)
+			d.Pipeline.Status = d.Job.Status
+			history[app] = append(history[app], d.Pipeline)
+		}
+		return history, nil
+	}
+
+	pipelines, err := git.RecentPipelines(max)
+	if err != nil {
+		return nil, fmt.Errorf("wasn't able to list pipelines: %s", err)
+	}
+	wanted := make(map[string]bool)
+	for _, app := range apps {
+		wanted[app] = true
+	}
+	for _, p := range pipelines {
+		variables, err := git.PipelineVariables(p.Id)
+		if err != nil {
+			return nil, fmt.Errorf("wasn't able to get variables of pipeline %d: %s", p.Id, err)
+		}
+		app := variables["app_name"]
+		if variables["client_id"] != client || (app != "" && !wanted[app]) {
+			continue
+		}
+		jobs, err := git.ListJobs(p.Id)
+		if err != nil {
+			return nil, fmt.Errorf("wasn't able to list jobs of pipeline %d: %s", p.Id, err)
+		}
+		if !deploysApp(app, playedJobNames(jobs)) {
+			continue
+		}
+		p.Sha = deployedSha(p.Sha, variables)
+		if app != "" {
+			history[app] = append(history[app], p)
+			continue
+		}
+		for _, app := range apps {
+			history[app] = append(history[app], p)
+		}
+	}
+	return history, nil
+}
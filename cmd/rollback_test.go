@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestRollbackFetchesPipelinesOnce(t *testing.T) {
+	project := newHistoryProject(t,
+		deployment(4, "acme", "web", "dddd", "deploy"),
+		deployment(3, "acme", "api", "cccc", "deploy"),
+		deployment(2, "acme", "web", "bbbb", "deploy"),
+		deployment(1, "acme", "api", "aaaa", "deploy"),
+	)
+
+	output, succeeded := runDeployer(t, historyDir(t, project), "rollback", "acme", "--dry-run")
+
+	if !succeeded {
+		t.Fatalf("expected the rollback dry run to succeed:\n%s", output)
+	}
+	for _, expected := range []string{`api\s+master@cccc.*master@aaaa\s+1`, `web\s+master@dddd.*master@bbbb\s+2`} {
+		if !regexp.MustCompile(expected).MatchString(output) {
+			t.Errorf("expected a rollback matching %q:\n%s", expected, output)
+		}
+	}
+	if project.requested("pipelines") != 1 {
+		t.Errorf("expected pipelines to be listed once, got %d times", project.requested("pipelines"))
+	}
+	for id := 1; id <= 4; id++ {
+		path := fmt.Sprintf("pipelines/%d/variables", id)
+		if project.requested(path) != 1 {
+			t.Errorf("expected the variables of pipeline %d to be fetched once, got %d times", id, project.requested(path))
+		}
+	}
+}
+
+func TestRollbackAfterRollback(t *testing.T) {
+	// Pipeline 3 rolled api back to aaaa, it ran on the head of master
+	rollback := deployment(3, "acme", "api", "cccc", "deploy")
+	rollback.variables["deploy_sha"] = "aaaa"
+	project := newHistoryProject(t,
+		rollback,
+		deployment(2, "acme", "api", "cccc", "deploy"),
+		deployment(1, "acme", "api", "aaaa", "deploy"),
+	)
+
+	output, succeeded := runDeployer(t, historyDir(t, project), "rollback", "acme", "api", "--dry-run")
+
+	if !succeeded {
+		t.Fatalf("expected the rollback dry run to succeed:\n%s", output)
+	}
+	if expected := `api\s+master@aaaa \(success\)\s+master@cccc\s+2`; !regexp.MustCompile(expected).MatchString(output) {
+		t.Errorf("expected api to be at the sha rolled back to and to return to pipeline 2, matching %q:\n%s", expected, output)
+	}
+}
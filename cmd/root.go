@@ -38,7 +38,9 @@ func init() {
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./.deployer.yaml)")
-	rootCmd.PersistentFlags().StringVar(&clientFile, "clientfile", "", "config file (default is ./clients.csv)")
+	rootCmd.PersistentFlags().StringVar(&clientFile, "clientfile", "", "clients file (default is ./clients.csv)")
+	rootCmd.PersistentFlags().String("clients-source", "local", "where the clients file is read from: local or gitlab (deploy repository)")
+	viper.BindPFlag("clients_source", rootCmd.PersistentFlags().Lookup("clients-source"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MySocialApp/msa-deployer/registry"
+	"github.com/spf13/cobra"
+)
+
+// addSelectorFlags adds the flags narrowing the clients a bulk command runs on
+func addSelectorFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("select", nil, "only clients whose columns match, as column=value[,column=value] (tag=beta,region=eu), values can be glob patterns")
+	cmd.Flags().StringSlice("exclude", nil, "client ids or glob patterns to leave out")
+	cmd.Flags().String("from-file", "", "only clients listed in this file, one id or glob pattern per line")
+}
+
+// clientSelector builds the selector of a bulk command from its target (client ids or glob patterns
+// separated by commas, or all) and its selector flags
+func clientSelector(cmd *cobra.Command, target string) (*registry.Selector, error) {
+	selector := &registry.Selector{Ids: splitTarget(target)}
+
+	exprs, _ := cmd.Flags().GetStringArray("select")
+	for _, expr := range exprs {
+		conditions, err := registry.ParseConditions(expr)
+		if err != nil {
+			return nil, err
+		}
+		selector.Conditions = append(selector.Conditions, conditions...)
+	}
+	selector.Exclude, _ = cmd.Flags().GetStringSlice("exclude")
+
+	if path := flagString(cmd, "from-file"); path != "" {
+		if target != registry.All {
+			return nil, fmt.Errorf("--from-file selects clients itself, use it with all instead of %s", target)
+		}
+		ids, err := readIdsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		selector.Ids = ids
+	}
+	return selector, nil
+}
+
+// selectClients returns clients of the registry selected by the target and the selector flags of cmd
+func selectClients(cmd *cobra.Command, reg *registry.Registry, target string) ([]*registry.Client, error) {
+	selector, err := clientSelector(cmd, target)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := reg.Select(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no client of %s matches the selection", reg.Path)
+	}
+	return clients, nil
+}
+
+// splitTarget splits client ids or patterns separated by commas
+func splitTarget(target string) []string {
+	var ids []string
+	for _, id := range strings.Split(target, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// readIdsFile reads client ids or patterns, one per line, blank lines and # comments are ignored
+func readIdsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text != "" && !strings.HasPrefix(text, "#") {
+			ids = append(ids, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no client id in %s", path)
+	}
+	return ids, nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MySocialApp/msa-deployer/registry"
+	"github.com/spf13/cobra"
+)
+
+func TestSelectClientsFlags(t *testing.T) {
+	reg, err := registry.Parse(strings.NewReader(`client_id,apps,tags,region
+acme-eu,api;web,beta,eu
+acme-us,api,beta,us
+globex,web,,eu
+initech,api,vip,us
+`), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idsFile := filepath.Join(t.TempDir(), "clients.txt")
+	if err := ioutil.WriteFile(idsFile, []byte("# rollout\nacme-*\n\ninitech\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		target   string
+		flags    map[string]string
+		expected string
+	}{
+		{"target list", "globex, acme-*", nil, "acme-eu,acme-us,globex"},
+		{"select", "all", map[string]string{"select": "tag=beta,region=eu"}, "acme-eu"},
+		{"exclude", "all", map[string]string{"select": "app=api", "exclude": "acme-eu,initech"}, "acme-us"},
+		{"from file", "all", map[string]string{"from-file": idsFile, "exclude": "acme-us"}, "acme-eu,initech"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := &cobra.Command{}
+			addSelectorFlags(cmd)
+			for name, value := range test.flags {
+				if err := cmd.Flags().Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			clients, err := selectClients(cmd, reg, test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, client := range clients {
+				ids = append(ids, client.Id)
+			}
+			if strings.Join(ids, ",") != test.expected {
+				t.Errorf("expected clients %q, got %q", test.expected, strings.Join(ids, ","))
+			}
+		})
+	}
+
+	cmd := &cobra.Command{}
+	addSelectorFlags(cmd)
+	cmd.Flags().Set("from-file", idsFile)
+	if _, err := selectClients(cmd, reg, "globex"); err == nil {
+		t.Error("expected --from-file to require all")
+	}
+	cmd.Flags().Set("from-file", "")
+	cmd.Flags().Set("select", "region=us*")
+	if _, err := selectClients(cmd, reg, "globex"); err == nil || !strings.Contains(err.Error(), "no client") {
+		t.Errorf("expected an empty selection to fail, got %v", err)
+	}
+}
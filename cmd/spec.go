@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// defaultRef is the git ref pipelines are triggered on when none is configured
+	defaultRef = "master"
+	// defaultJobName is the manual job played when none is configured
+	defaultJobName = "deploy"
+)
+
+// newDeploySpec resolves the ref, variables and jobs of a deploy. Command line options take precedence
+// over the app settings (apps.<app name> in the config file), which take precedence over global settings
+// (deploy_ref, deploy_variables and deploy_jobs). Variables are merged as described by resolveVariableLayers.
+func newDeploySpec(cmd *cobra.Command, reg *registry.Registry, args []string) (*deploy.Spec, error) {
+	spec := &deploy.Spec{
+		Variables:       make(map[string]string),
+		ClientVariables: make(map[string]map[string]string),
+		Overrides:       make(map[string]string),
+	}
+	if len(args) >= 2 {
+		spec.App = args[1]
+	}
+
+	// Git ref
+	spec.Ref = firstString(
+		flagString(cmd, "ref"),
+		appSetting(spec.App, "ref"),
+		viper.GetString("deploy_ref"),
+		defaultRef,
+	)
+
+	// Jobs to play
+	spec.Jobs, _ = cmd.Flags().GetStringSlice("job")
+	if len(spec.Jobs) == 0 {
+		spec.Jobs = deployJobs(spec.App)
+	}
+
+	// Extra variables
+	shared, err := sharedVariableLayers(reg, spec.App)
+	if err != nil {
+		return nil, err
+	}
+	spec.Variables = shared.merged()
+	for _, client := range reg.Clients {
+		if layers := clientVariableLayers(reg, client, spec.App); len(layers) > 0 {
+			spec.ClientVariables[client.Id] = layers.merged()
+		}
+	}
+	overrides, err := commandLineVariableLayers(cmd)
+	if err != nil {
+		return nil, err
+	}
+	spec.Overrides = overrides.merged()
+
+	return spec, nil
+}
+
+// variableLayer is a set of pipeline variables, source telling where they come from
+type variableLayer struct {
+	source    string
+	variables map[string]string
+}
+
+// variableLayers are sets of pipeline variables from the lowest to the highest precedence
+type variableLayers []variableLayer
+
+// merged returns variables of every layer, a variable of a layer overriding the ones of previous layers
+func (layers variableLayers) merged() map[string]string {
+	variables := make(map[string]string)
+	for _, layer := range layers {
+		for key, value := range layer.variables {
+			variables[key] = value
+		}
+	}
+	return variables
+}
+
+// add appends variables as a layer, names set by the deployer are refused
+func (layers *variableLayers) add(source string, variables map[string]string) error {
+	for _, reserved := range registry.ReservedVariables {
+		if _, ok := variables[reserved]; ok {
+			return fmt.Errorf("variable %s of %s is set by the deployer and can't be overridden", reserved, source)
+		}
+	}
+	layers.addChecked(source, variables)
+	return nil
+}
+
+// addChecked appends variables of the clients file as a layer, reserved names are refused when it's loaded
+func (layers *variableLayers) addChecked(source string, variables map[string]string) {
+	if len(variables) > 0 {
+		*layers = append(*layers, variableLayer{source: source, variables: variables})
+	}
+}
+
+// addPairs appends KEY=VALUE pairs as a layer
+func (layers *variableLayers) addPairs(source string, pairs []string) error {
+	variables := make(map[string]string)
+	if err := parseVariables(pairs, variables); err != nil {
+		return err
+	}
+	return layers.add(source, variables)
+}
+
+// resolveVariableLayers returns pipeline variables of a client from the lowest to the highest precedence:
+//  1. deploy_variables of the config file
+//  2. variables of the clients file
+//  3. apps.<app name>.variables of the config file
+//  4. app_variables.<app name> of the clients file
+//  5. variables of the client in the clients file
+//  6. app_variables.<app name> of the client in the clients file
+//  7. --var command line options
+func resolveVariableLayers(cmd *cobra.Command, reg *registry.Registry, client *registry.Client, app string) (variableLayers, error) {
+	shared, err := sharedVariableLayers(reg, app)
+	if err != nil {
+		return nil, err
+	}
+	clientLayers := clientVariableLayers(reg, client, app)
+	overrides, err := commandLineVariableLayers(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(shared, clientLayers...), overrides...), nil
+}
+
+// sharedVariableLayers returns variables of every client (1 to 4 of resolveVariableLayers). Variables of the config file
+// are KEY=VALUE lists since config keys are case insensitive
+func sharedVariableLayers(reg *registry.Registry, app string) (variableLayers, error) {
+	var layers variableLayers
+	if err := layers.addPairs("deploy_variables", viper.GetStringSlice("deploy_variables")); err != nil {
+		return nil, err
+	}
+	layers.addChecked(reg.Path, reg.Variables)
+	if app == "" {
+		return layers, nil
+	}
+	if err := layers.addPairs("apps."+app+".variables", viper.GetStringSlice("apps."+app+".variables")); err != nil {
+		return nil, err
+	}
+	layers.addChecked(reg.Path+" app "+app, reg.AppVariables[app])
+	return layers, nil
+}
+
+// clientVariableLayers returns variables of a client in the clients file (5 and 6 of resolveVariableLayers)
+func clientVariableLayers(reg *registry.Registry, client *registry.Client, app string) variableLayers {
+	var layers variableLayers
+	layers.addChecked(reg.Path+" client "+client.Id, client.Variables)
+	if app == "" {
+		return layers
+	}
+	layers.addChecked(reg.Path+" client "+client.Id+" app "+app, client.AppVariables[app])
+	return layers
+}
+
+// commandLineVariableLayers returns variables given with --var (7 of resolveVariableLayers)
+func commandLineVariableLayers(cmd *cobra.Command) (variableLayers, error) {
+	var layers variableLayers
+	vars, _ := cmd.Flags().GetStringArray("var")
+	if err := layers.addPairs("--var", vars); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// parseVariables adds KEY=VALUE pairs to variables
+func parseVariables(pairs []string, variables map[string]string) error {
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid variable %q, expected KEY=VALUE", pair)
+		}
+		variables[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// appSetting returns a setting of the app from the config file
+func appSetting(app string, key string) string {
+	if app == "" {
+		return ""
+	}
+	return viper.GetString("apps." + app + "." + key)
+}
+
+// appSettingSlice returns a list setting of the app, or the global setting, or fallback when none is set
+func appSettingSlice(app string, appKey string, globalKey string, fallback []string) []string {
+	if app != "" {
+		if values := viper.GetStringSlice("apps." + app + "." + appKey); len(values) > 0 {
+			return values
+		}
+	}
+	if values := viper.GetStringSlice(globalKey); len(values) > 0 {
+		return values
+	}
+	return fallback
+}
+
+func flagString(cmd *cobra.Command, name string) string {
+	value, _ := cmd.Flags().GetString(name)
+	return value
+}
+
+func firstString(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/MySocialApp/msa-deployer/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// variablesFrom returns the variables level to level 7 set by a layer, with the layer as value
+func variablesFrom(level int) map[string]string {
+	variables := make(map[string]string)
+	for i := level; i <= 7; i++ {
+		variables[fmt.Sprintf("LEVEL_%d", i)] = fmt.Sprintf("layer %d", level)
+	}
+	return variables
+}
+
+// pairs returns variables as KEY=VALUE pairs
+func pairs(variables map[string]string) []string {
+	var result []string
+	for key, value := range variables {
+		result = append(result, key+"="+value)
+	}
+	return result
+}
+
+func TestResolveVariableLayers(t *testing.T) {
+	// Layer n sets LEVEL_n to LEVEL_7, so LEVEL_n is won by layer n
+	viper.Set("deploy_variables", pairs(variablesFrom(1)))
+	viper.Set("apps.api.variables", pairs(variablesFrom(3)))
+	defer viper.Set("deploy_variables", nil)
+	defer viper.Set("apps.api.variables", nil)
+	client := &registry.Client{
+		Id:           "acme",
+		Apps:         []string{"api"},
+		Variables:    variablesFrom(5),
+		AppVariables: map[string]map[string]string{"api": variablesFrom(6)},
+	}
+	reg := &registry.Registry{
+		Path:         "clients.yaml",
+		Clients:      []*registry.Client{client},
+		Variables:    variablesFrom(2),
+		AppVariables: map[string]map[string]string{"api": variablesFrom(4)},
+	}
+	cmd := &cobra.Command{}
+	cmd.Flags().StringArray("var", nil, "")
+	for _, pair := range pairs(variablesFrom(7)) {
+		cmd.Flags().Set("var", pair)
+	}
+
+	layers, err := resolveVariableLayers(cmd, reg, client, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []string{
+		"deploy_variables",
+		"clients.yaml",
+		"apps.api.variables",
+		"clients.yaml app api",
+		"clients.yaml client acme",
+		"clients.yaml client acme app api",
+		"--var",
+	}
+	if len(layers) != len(sources) {
+		t.Fatalf("expected %d layers, got %+v", len(sources), layers)
+	}
+	variables := layers.merged()
+	for i, source := range sources {
+		level := i + 1
+		if layers[i].source != source {
+			t.Errorf("expected layer %d to come from %s, got %s", level, source, layers[i].source)
+		}
+		// The last layer setting a variable wins
+		key := fmt.Sprintf("LEVEL_%d", level)
+		winner := ""
+		for _, layer := range layers {
+			if _, ok := layer.variables[key]; ok {
+				winner = layer.source
+			}
+		}
+		if expected := fmt.Sprintf("layer %d", level); variables[key] != expected || winner != source {
+			t.Errorf("expected %s to be %q from %s, got %q from %s", key, expected, source, variables[key], winner)
+		}
+	}
+
+	// --var overrides app variables of the client
+	if client.AppVariables["api"]["LEVEL_7"] != "layer 6" || variables["LEVEL_7"] != "layer 7" {
+		t.Errorf("expected --var to override app variables of the client, got %v", variables)
+	}
+
+	// Without app, app layers are left out
+	layers, err = resolveVariableLayers(cmd, reg, client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variables := layers.merged(); len(layers) != 4 || variables["LEVEL_3"] != "layer 2" || variables["LEVEL_6"] != "layer 5" {
+		t.Errorf("expected app layers to be left out, got %+v", layers)
+	}
+}
+
+func TestReservedVariables(t *testing.T) {
+	var layers variableLayers
+	if err := layers.add("deploy_variables", map[string]string{"client_id": "globex"}); err == nil {
+		t.Error("expected client_id to be refused")
+	}
+	if err := layers.addPairs("--var", []string{"app_name=web"}); err == nil {
+		t.Error("expected app_name to be refused")
+	}
+	if len(layers) != 0 {
+		t.Errorf("expected no layer, got %+v", layers)
+	}
+}
@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/MySocialApp/msa-deployer/deploy"
+	"github.com/MySocialApp/msa-deployer/registry"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	statusSourcePipelines    = "pipelines"
+	statusSourceEnvironments = "environments"
+
+	// defaultStatusEnvironment is the environment name of a client app when status_environment isn't set
+	defaultStatusEnvironment = "{client_id}/{app_name}"
+)
+
+// appStatus is the last deployment of an application of a client
+type appStatus struct {
+	Client     string       `json:"client_id"`
+	App        string       `json:"app_name"`
+	Ref        string       `json:"ref,omitempty"`
+	Sha        string       `json:"sha,omitempty"`
+	Time       *time.Time   `json:"time,omitempty"`
+	Operator   string       `json:"operator,omitempty"`
+	PipelineId int          `json:"pipeline_id,omitempty"`
+	Jobs       []*audit.Job `json:"jobs,omitempty"`
+	Status     string       `json:"status"`
+}
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [client id|pattern|all] [app name]",
+	Short: "Show the last deployment of client applications",
+	Long: `Show the last deployment of client applications: ref, sha, time, operator and result of the jobs.
+Deployments are looked up in the last pipelines of the deploy project, from their client_id and app_name variables,
+or in GitLab environment deployments with status_source: environments (status_environment names environments
+of client apps, {client_id}/{app_name} by default)`,
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := registry.All
+		if len(args) >= 1 {
+			target = args[0]
+		}
+		statuses, err := selectAppStatuses(cmd, target, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := findDeployments(newBackend(), statuses, maxPipelines(cmd)); err != nil {
+			log.Fatal(err)
+		}
+		statusOperators(statuses)
+
+		if err := printStatus(statuses, flagString(cmd, "output")); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	addSelectorFlags(statusCmd)
+	statusCmd.Flags().Int("max-pipelines", 100, "number of recent pipelines (or environment deployments) looked up (status_max_pipelines setting)")
+	statusCmd.Flags().StringP("output", "o", "table", "output format (table or json)")
+}
+
+// selectAppStatuses returns the applications of the selected clients whose last deployment has to be found,
+// only the application given as second argument if any
+func selectAppStatuses(cmd *cobra.Command, target string, args []string) ([]*appStatus, error) {
+	clients, err := selectClients(cmd, loadRegistry(), target)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []*appStatus
+	for _, client := range clients {
+		for _, app := range client.Apps {
+			if len(args) < 2 || app == args[1] {
+				statuses = append(statuses, &appStatus{Client: client.Id, App: app, Status: "not found"})
+			}
+		}
+	}
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("application %s is not set for any selected client", args[1])
+	}
+	return statuses, nil
+}
+
+// findDeployments fills statuses from the source set with status_source
+func findDeployments(git *backend.Gitlab, statuses []*appStatus, max int) error {
+	switch source := firstString(viper.GetString("status_source"), statusSourcePipelines); source {
+	case statusSourcePipelines:
+		return statusFromPipelines(git, statuses, max)
+	case statusSourceEnvironments:
+		return statusFromEnvironments(git, statuses, max)
+	default:
+		return fmt.Errorf("unknown status source %q, expected %s or %s", source, statusSourcePipelines, statusSourceEnvironments)
+	}
+}
+
+// statusFromPipelines fills statuses from the most recent pipelines which deployed each client app
+func statusFromPipelines(git *backend.Gitlab, statuses []*appStatus, max int) error {
+	pipelines, err := git.RecentPipelines(max)
+	if err != nil {
+		return fmt.Errorf("wasn't able to list pipelines: %s", err)
+	}
+
+	missing := len(statuses)
+	for _, p := range pipelines {
+		if missing == 0 {
+			break
+		}
+		variables, err := git.PipelineVariables(p.Id)
+		if err != nil {
+			return fmt.Errorf("wasn't able to get variables of pipeline %d: %s", p.Id, err)
+		}
+		app := variables["app_name"]
+		var found []*appStatus
+		for _, status := range findStatuses(statuses, variables["client_id"], app) {
+			if status.PipelineId == 0 {
+				found = append(found, status)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		pipeline, jobs, err := pipelineJobs(git, p.Id)
+		if err != nil {
+			return err
+		}
+		if !deploysApp(app, playedJobNames(jobs)) {
+			continue
+		}
+		pipeline.Sha = deployedSha(pipeline.Sha, variables)
+		for _, status := range found {
+			status.setJobs(pipeline, jobs)
+			missing--
+		}
+	}
+	return nil
+}
+
+// setPipelineJobs sets the pipeline of a status, its status and played jobs
+func (s *appStatus) setPipelineJobs(git backend.Backend, pipelineId int) error {
+	pipeline, jobs, err := pipelineJobs(git, pipelineId)
+	if err != nil {
+		return err
+	}
+	s.setJobs(pipeline, jobs)
+	return nil
+}
+
+// pipelineJobs returns the current state of a pipeline and its jobs
+func pipelineJobs(git backend.Backend, pipelineId int) (*backend.Pipeline, []*backend.Job, error) {
+	pipeline, err := git.GetPipeline(pipelineId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wasn't able to get pipeline %d: %s", pipelineId, err)
+	}
+	jobs, err := git.ListJobs(pipelineId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wasn't able to list jobs of pipeline %d: %s", pipelineId, err)
+	}
+	return pipeline, jobs, nil
+}
+
+// setJobs sets the pipeline of a status, its status and played jobs
+func (s *appStatus) setJobs(pipeline *backend.Pipeline, jobs []*backend.Job) {
+	s.setPipeline(pipeline)
+	s.Status = pipeline.Status
+	s.Jobs = nil
+	for _, job := range jobs {
+		if played(job) {
+			s.Jobs = append(s.Jobs, &audit.Job{Name: job.Name, Id: job.Id, Status: job.Status})
+		}
+	}
+}
+
+// played tells if a job has been run, manual jobs which haven't been played being left out
+func played(job *backend.Job) bool {
+	switch job.Status {
+	case backend.StatusManual, backend.StatusCreated, backend.StatusSkipped:
+		return false
+	}
+	return true
+}
+
+// playedJobNames returns the names of the jobs which have been run
+func playedJobNames(jobs []*backend.Job) []string {
+	var names []string
+	for _, job := range jobs {
+		if played(job) {
+			names = append(names, job.Name)
+		}
+	}
+	return names
+}
+
+// deployJobs returns the jobs deploy plays for an application (every application of a client when app is empty)
+func deployJobs(app string) []string {
+	return appSettingSlice(app, "jobs", "deploy_jobs", []string{defaultJobName})
+}
+
+// deploysApp tells if one of the jobs played in a pipeline of app is a deploy job, so that teardown, ingress and
+// creation pipelines of a client aren't taken for deployments
+func deploysApp(app string, playedJobs []string) bool {
+	for _, job := range deployJobs(app) {
+		for _, name := range playedJobs {
+			if name == job {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rollbackShaVariable returns the variable giving jobs the sha to deploy
+func rollbackShaVariable() string {
+	return firstString(viper.GetString("rollback_sha_variable"), defaultRollbackShaVariable)
+}
+
+// deployedSha returns the sha deployed by a pipeline triggered with variables. Rollback pipelines run on the head
+// of a ref, the sha they deploy is the one given in the rollback sha variable
+func deployedSha(sha string, variables map[string]string) string {
+	return firstString(variables[rollbackShaVariable()], sha)
+}
+
+// statusFromEnvironments fills statuses from the most recent deployment of each client app environment
+func statusFromEnvironments(git *backend.Gitlab, statuses []*appStatus, max int) error {
+	deployments, err := git.RecentDeployments(max)
+	if err != nil {
+		return fmt.Errorf("wasn't able to list deployments: %s", err)
+	}
+
+	environments := make(map[string]*appStatus)
+	for _, status := range statuses {
+		environments[statusEnvironment(status.Client, status.App)] = status
+	}
+	for _, d := range deployments {
+		status := environments[d.Environment]
+		if status == nil || status.PipelineId != 0 {
+			continue
+		}
+		variables, err := git.PipelineVariables(d.Pipeline.Id)
+		if err != nil {
+			return fmt.Errorf("wasn't able to get variables of pipeline %d: %s", d.Pipeline.Id, err)
+		}
+		d.Pipeline.Sha = deployedSha(d.Pipeline.Sha, variables)
+		status.setPipeline(d.Pipeline)
+		status.Status = d.Job.Status
+		status.Jobs = []*audit.Job{{Name: d.Job.Name, Id: d.Job.Id, Status: d.Job.Status}}
+	}
+	return nil
+}
+
+// statusEnvironment returns the GitLab environment name of a client application
+func statusEnvironment(client string, app string) string {
+	template := firstString(viper.GetString("status_environment"), defaultStatusEnvironment)
+	return strings.NewReplacer("{client_id}", client, "{app_name}", app).Replace(template)
+}
+
+// maxPipelines returns the number of pipelines looked up: --max-pipelines, or status_max_pipelines when the flag isn't set
+func maxPipelines(cmd *cobra.Command) int {
+	max, _ := cmd.Flags().GetInt("max-pipelines")
+	if !cmd.Flags().Changed("max-pipelines") && viper.IsSet("status_max_pipelines") {
+		max = viper.GetInt("status_max_pipelines")
+	}
+	return max
+}
+
+func (s *appStatus) setPipeline(pipeline *backend.Pipeline) {
+	s.PipelineId = pipeline.Id
+	s.Ref = pipeline.Ref
+	s.Sha = pipeline.Sha
+	s.Operator = pipeline.User
+	if !pipeline.CreatedAt.IsZero() {
+		s.Time = &pipeline.CreatedAt
+	}
+}
+
+// findStatuses returns the statuses of the apps of client deployed by a pipeline of app, every app of the client
+// when app is empty as deploy without an app name deploys them all
+func findStatuses(statuses []*appStatus, client string, app string) []*appStatus {
+	var found []*appStatus
+	for _, status := range statuses {
+		if status.Client == client && (app == "" || status.App == app) {
+			found = append(found, status)
+		}
+	}
+	return found
+}
+
+// statusOperators replaces pipeline users by the operators recorded in the audit log, as triggered pipelines
+// belong to the trigger owner
+func statusOperators(statuses []*appStatus) {
+	entries, err := audit.Read(auditLog())
+	if err != nil {
+		log.Warnf("Wasn't able to read audit log %s: %s", auditLog(), err)
+		return
+	}
+	operators := make(map[int]string)
+	for _, entry := range entries {
+		for _, pipeline := range entry.Pipelines {
+			operators[pipeline.PipelineId] = entry.Operator
+		}
+	}
+	for _, status := range statuses {
+		if operator, ok := operators[status.PipelineId]; ok && status.PipelineId != 0 {
+			status.Operator = operator
+		}
+	}
+}
+
+// shortSha returns the abbreviated form of a commit sha
+func shortSha(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+// printStatus prints statuses as a table or as JSON
+func printStatus(statuses []*appStatus, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	case "table":
+	default:
+		return fmt.Errorf("unknown output format %q, expected table or json", format)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tAPP\tREF\tSHA\tTIME\tOPERATOR\tPIPELINE\tJOBS\tSTATUS")
+	for _, s := range statuses {
+		when := "-"
+		if s.Time != nil {
+			when = s.Time.Local().Format("2006-01-02 15:04:05")
+		}
+		var jobs []string
+		for _, job := range s.Jobs {
+			jobs = append(jobs, job.Name+":"+job.Status)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Client, s.App, firstString(s.Ref, "-"), firstString(shortSha(s.Sha), "-"), when,
+			firstString(s.Operator, "-"), deploy.IdOrDash(s.PipelineId), firstString(strings.Join(jobs, ","), "-"), s.Status)
+	}
+	return w.Flush()
+}
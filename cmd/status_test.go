@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	"github.com/xanzy/go-gitlab"
+)
+
+// recordedPipeline is a pipeline of the deploy project history
+type recordedPipeline struct {
+	id        int
+	status    string
+	sha       string
+	variables map[string]string
+	jobs      []*gitlab.Job
+}
+
+// historyProject serves pipelines of a GitLab project, the most recent first. Requests are counted by path
+type historyProject struct {
+	*httptest.Server
+	t         *testing.T
+	pipelines []*recordedPipeline
+	// retryErrors are the status codes replied when retrying jobs, by job id
+	retryErrors map[int]int
+
+	mu       sync.Mutex
+	requests map[string]int
+	nextJob  int
+}
+
+func newHistoryProject(t *testing.T, pipelines ...*recordedPipeline) *historyProject {
+	p := &historyProject{t: t, pipelines: pipelines, retryErrors: make(map[int]int), requests: make(map[string]int), nextJob: 1000}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// deployment returns a successful pipeline of a client app which played jobs
+func deployment(id int, client string, app string, sha string, jobs ...string) *recordedPipeline {
+	p := &recordedPipeline{id: id, status: backend.StatusSuccess, sha: sha, variables: map[string]string{"client_id": client, "app_name": app}}
+	for i, name := range jobs {
+		p.jobs = append(p.jobs, &gitlab.Job{ID: id*10 + i, Name: name, Status: backend.StatusSuccess})
+	}
+	return p
+}
+
+func (p *historyProject) serve(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/"), "/")
+	p.requests[strings.Join(path, "/")]++
+	id := 0
+	if len(path) > 1 {
+		id, _ = strconv.Atoi(path[1])
+	}
+	route := r.Method + " " + path[0]
+	if len(path) > 2 {
+		route += "/:id/" + path[2]
+	} else if len(path) > 1 {
+		route += "/:id"
+	}
+
+	pipeline, job := p.pipeline(id), p.job(id)
+	if (path[0] == "pipelines" && len(path) > 1 && pipeline == nil) || (path[0] == "jobs" && job == nil) {
+		http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+		return
+	}
+	var reply interface{}
+	switch route {
+	case "GET pipelines":
+		var list gitlab.PipelineList
+		for _, pipeline := range p.pipelines {
+			list = append(list, struct {
+				ID     int    `json:"id"`
+				Status string `json:"status"`
+				Ref    string `json:"ref"`
+				Sha    string `json:"sha"`
+			}{pipeline.id, pipeline.status, "master", pipeline.sha})
+		}
+		reply = list
+	case "GET pipelines/:id":
+		reply = &gitlab.Pipeline{ID: pipeline.id, Status: pipeline.status, Ref: "master", Sha: pipeline.sha}
+	case "GET pipelines/:id/variables":
+		var variables []*gitlab.PipelineVariable
+		for key, value := range pipeline.variables {
+			variables = append(variables, &gitlab.PipelineVariable{Key: key, Value: value})
+		}
+		reply = variables
+	case "GET pipelines/:id/jobs":
+		reply = pipeline.jobs
+	case "GET jobs/:id":
+		reply = job
+	case "POST jobs/:id/retry":
+		if code := p.retryErrors[id]; code != 0 {
+			http.Error(w, `{"message":"retry refused"}`, code)
+			return
+		}
+		retried := &gitlab.Job{ID: p.nextJob, Name: job.Name, Status: backend.StatusSuccess}
+		p.nextJob++
+		for _, pipeline := range p.pipelines {
+			for _, j := range pipeline.jobs {
+				if j == job {
+					pipeline.jobs = append(pipeline.jobs, retried)
+					break
+				}
+			}
+		}
+		reply = retried
+	default:
+		p.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (p *historyProject) pipeline(id int) *recordedPipeline {
+	for _, pipeline := range p.pipelines {
+		if pipeline.id == id {
+			return pipeline
+		}
+	}
+	return nil
+}
+
+func (p *historyProject) job(id int) *gitlab.Job {
+	for _, pipeline := range p.pipelines {
+		for _, job := range pipeline.jobs {
+			if job.ID == id {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// requested returns how many times path has been requested
+func (p *historyProject) requested(path string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests[path]
+}
+
+// historyDir returns a deployer directory using the project with the client acme deploying api and web
+func historyDir(t *testing.T, project *historyProject) string {
+	dir := deployerDir(t, project.URL)
+	if err := ioutil.WriteFile(filepath.Join(dir, "clients.csv"), []byte("client_id,apps\nacme,api;web\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStatusFindsDeployments(t *testing.T) {
+	rollback := deployment(4, "acme", "api", "ffff", "deploy")
+	rollback.variables["deploy_sha"] = "aaaa"
+	project := newHistoryProject(t,
+		deployment(6, "acme", "api", "ffff", "remove-client"),
+		deployment(5, "acme", "", "ffff", "ingress"),
+		rollback,
+		deployment(3, "acme", "", "cccc", "deploy"),
+		deployment(2, "acme", "web", "bbbb", "deploy"),
+	)
+
+	output, succeeded := runDeployer(t, historyDir(t, project), "status", "acme", "-o", "json")
+
+	if !succeeded {
+		t.Fatalf("expected status to succeed:\n%s", output)
+	}
+	var statuses []*appStatus
+	if err := json.Unmarshal([]byte(output[strings.Index(output, "["):]), &statuses); err != nil {
+		t.Fatalf("%s:\n%s", err, output)
+	}
+	expected := []struct {
+		app      string
+		pipeline int
+		sha      string
+	}{{"api", 4, "aaaa"}, {"web", 3, "cccc"}}
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d statuses, got %d:\n%s", len(expected), len(statuses), output)
+	}
+	for i, e := range expected {
+		if s := statuses[i]; s.App != e.app || s.PipelineId != e.pipeline || s.Sha != e.sha {
+			t.Errorf("expected %s deployed by pipeline %d at %s, got %s by pipeline %d at %s", e.app, e.pipeline, e.sha, s.App, s.PipelineId, s.Sha)
+		}
+	}
+	if project.requested("pipelines/2/variables") != 0 {
+		t.Error("expected pipelines to be looked up until every app has been found")
+	}
+}
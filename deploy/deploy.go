@@ -0,0 +1,352 @@
+// Package deploy triggers deployment pipelines for clients, plays their jobs and waits for them to end.
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// StatusTimeout is reported when a job did not reach a terminal state in time
+	StatusTimeout = "timeout"
+	// StatusError is reported when the pipeline or the job couldn't be launched
+	StatusError = "error"
+	// StatusHalted is reported for clients left undeployed after a wave failed
+	StatusHalted = "halted"
+)
+
+// Spec describes the pipeline triggered for each client: git ref, extra variables and jobs to play
+type Spec struct {
+	App       string            `json:"app_name,omitempty"`
+	Ref       string            `json:"ref"`
+	Variables map[string]string `json:"variables,omitempty"`
+	// ClientVariables are variables of some clients (by client id), overriding Variables
+	ClientVariables map[string]map[string]string `json:"client_variables,omitempty"`
+	// Overrides are variables overriding any other, e.g. given on the command line
+	Overrides map[string]string `json:"overrides,omitempty"`
+	Jobs      []string          `json:"jobs"`
+}
+
+// Args returns client id and app name (if any) as given on the command line
+func (s *Spec) Args(clientName string) []string {
+	if s.App == "" {
+		return []string{clientName}
+	}
+	return []string{clientName, s.App}
+}
+
+// TriggerVariables returns the forms added to the pipeline trigger of a client
+func (s *Spec) TriggerVariables(clientName string) map[string]string {
+	customForms := make(map[string]string)
+	for _, variables := range []map[string]string{s.Variables, s.ClientVariables[clientName], s.Overrides} {
+		for key, value := range variables {
+			customForms[key] = value
+		}
+	}
+	customForms["client_id"] = clientName
+	if s.App != "" {
+		customForms["app_name"] = s.App
+	}
+	return customForms
+}
+
+// Options tunes how deployments are launched and waited for
+type Options struct {
+	// Parallel is the number of clients launched at the same time
+	Parallel int
+	// Timeout is the maximum time to wait for launched jobs to end
+	Timeout time.Duration
+	// JobsTimeout is the maximum time to wait for jobs to appear in a new pipeline
+	JobsTimeout time.Duration
+	// PollInterval is the delay between two status checks
+	PollInterval time.Duration
+	// Follow prints job traces while waiting for them
+	Follow bool
+}
+
+// Deployer launches deployments on a backend
+type Deployer struct {
+	Backend backend.Backend
+	Options Options
+	// Traces receives followed job traces
+	Traces *TraceWriter
+	// OnUpdate is called when a deployment changed: pipeline triggered, job played, jobs ended or halted.
+	// It's called from the goroutine handling the deployment, which must not be kept
+	OnUpdate func(d *Deployment)
+
+	mu      sync.Mutex
+	stopped bool
+	// running are deployments whose pipeline has been triggered and which haven't been waited for yet
+	running []*Deployment
+}
+
+// New returns a deployer printing followed traces on stdout
+func New(b backend.Backend, opts Options) *Deployer {
+	return &Deployer{Backend: b, Options: opts, Traces: NewTraceWriter(os.Stdout)}
+}
+
+// Deployment is a pipeline which has been triggered for a client, with the jobs played in it
+type Deployment struct {
+	Client     string
+	PipelineId int
+	Jobs       []*PlayedJob
+	Status     string
+	Error      error
+	// Retryable tells if Error is transient (GitLab rate limiting or unavailable) rather than permanent
+	Retryable bool
+}
+
+// PlayedJob is a manual job played in a deployment pipeline
+type PlayedJob struct {
+	Name   string `json:"name"`
+	Id     int    `json:"id"`
+	Status string `json:"status,omitempty"`
+}
+
+// Succeeded tells if every deployed job ended successfully
+func (d *Deployment) Succeeded() bool {
+	return d.Status == backend.StatusSuccess
+}
+
+// JobIds returns ids of played jobs separated by commas
+func (d *Deployment) JobIds() string {
+	ids := make([]string, len(d.Jobs))
+	for i, job := range d.Jobs {
+		ids[i] = strconv.Itoa(job.Id)
+	}
+	if len(ids) == 0 {
+		return "-"
+	}
+	return strings.Join(ids, ",")
+}
+
+// played tells if a job has been played in the deployment
+func (d *Deployment) played(jobName string) bool {
+	for _, job := range d.Jobs {
+		if job.Name == jobName {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records a launch error
+func (d *Deployment) fail(err error) {
+	log.Errorf("Deployment of %s failed: %s", d.Client, err)
+	d.Status = StatusError
+	d.Error = err
+	d.Retryable = backend.IsRetryable(err)
+}
+
+// Launch triggers a pipeline and plays the requested jobs for every client.
+// Up to Options.Parallel clients are handled at the same time, a failing client doesn't stop the others.
+func (dp *Deployer) Launch(clients []string, spec *Spec) []*Deployment {
+	deployments := make([]*Deployment, len(clients))
+	for i, clientName := range clients {
+		deployments[i] = &Deployment{Client: clientName}
+	}
+	dp.each(deployments, func(d *Deployment) {
+		dp.launch(d, spec)
+	})
+	return deployments
+}
+
+// each calls launch for every deployment, Options.Parallel at the same time. Deployments which haven't been
+// handled when the deployer is stopped are halted
+func (dp *Deployer) each(deployments []*Deployment, launch func(d *Deployment)) {
+	parallel := dp.Options.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	queue := make(chan *Deployment)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range queue {
+				if dp.Stopped() {
+					d.Status = StatusHalted
+				} else {
+					launch(d)
+				}
+				dp.notify(d)
+			}
+		}()
+	}
+	for _, d := range deployments {
+		queue <- d
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// launch makes the pipeline, gets its jobs and runs the requested jobs for a single client
+func (dp *Deployer) launch(d *Deployment, spec *Spec) {
+	pipeline, err := dp.Backend.TriggerPipeline(spec.Ref, spec.TriggerVariables(d.Client))
+	if err != nil {
+		d.fail(fmt.Errorf("wasn't able to create the pipeline: %w", err))
+		return
+	}
+	d.PipelineId = pipeline.Id
+	dp.track(d)
+	dp.notify(d)
+
+	dp.playJobs(d, spec)
+}
+
+// playJobs runs the requested jobs which haven't been played yet in the pipeline of a deployment
+func (dp *Deployer) playJobs(d *Deployment, spec *Spec) {
+	var names []string
+	for _, jobName := range spec.Jobs {
+		if !d.played(jobName) {
+			names = append(names, jobName)
+		}
+	}
+	jobs, err := dp.WaitJobs(d.PipelineId, names)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+
+	for _, jobName := range names {
+		if dp.Stopped() {
+			if len(d.Jobs) == 0 {
+				dp.untrack(d)
+				d.Status = StatusHalted
+			}
+			return
+		}
+		jobId, err := dp.RunJob(d.PipelineId, jobs, jobName, spec.Args(d.Client))
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		d.Jobs = append(d.Jobs, &PlayedJob{Name: jobName, Id: jobId})
+		dp.notify(d)
+	}
+}
+
+// Wait waits for every launched job to end, following their traces if requested. The jobs played in deployments
+// which failed afterwards are waited for too, the deployments keeping their error.
+// Trace lines are prefixed by the client id when prefixed is set.
+func (dp *Deployer) Wait(deployments []*Deployment, prefixed bool) {
+	deadline := time.Now().Add(dp.Options.Timeout)
+	var wg sync.WaitGroup
+	for _, d := range deployments {
+		if (d.Error != nil && len(d.Jobs) == 0) || d.Status == StatusHalted {
+			continue
+		}
+		wg.Add(1)
+		go func(d *Deployment) {
+			defer wg.Done()
+			dp.wait(d, deadline, prefixed)
+			dp.untrack(d)
+			dp.notify(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// wait waits for the jobs of a deployment one after the other, the deployment status
+// is the one of the first job which didn't succeed, or the error status of a deployment which failed
+func (dp *Deployer) wait(d *Deployment, deadline time.Time, prefixed bool) {
+	if d.Error == nil {
+		d.Status = backend.StatusSuccess
+	}
+	for _, job := range d.Jobs {
+		var trace *jobTrace
+		if dp.Options.Follow {
+			label := d.Client
+			if len(d.Jobs) > 1 {
+				label += "/" + job.Name
+			}
+			trace = dp.Traces.newJobTrace(label, prefixed || len(d.Jobs) > 1)
+		}
+		status, err := dp.WaitJob(d.PipelineId, job.Id, deadline, trace)
+		job.Status = status
+		if err != nil && d.Error == nil {
+			d.Error = err
+		}
+		if job.Status == backend.StatusSuccess {
+			log.Infof("Job %s of %s ended with status %s", job.Name, d.Client, job.Status)
+		} else {
+			log.Errorf("Job %s of %s ended with status %s (job %s)", job.Name, d.Client, job.Status, strconv.Itoa(job.Id))
+			if d.Succeeded() {
+				d.Status = job.Status
+			}
+		}
+	}
+}
+
+// Stop prevents launching deployments of clients which haven't been started yet, launched ones go on
+func (dp *Deployer) Stop() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.stopped = true
+}
+
+// Stopped tells if Stop has been called
+func (dp *Deployer) Stopped() bool {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	return dp.stopped
+}
+
+// Running returns the count of triggered deployments whose jobs haven't ended yet
+func (dp *Deployer) Running() int {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	return len(dp.running)
+}
+
+// CancelRunning cancels the pipelines of triggered deployments whose jobs haven't ended yet,
+// waiting for them then ends with the canceled status. It returns the count of canceled pipelines.
+func (dp *Deployer) CancelRunning() int {
+	dp.mu.Lock()
+	running := append([]*Deployment(nil), dp.running...)
+	dp.mu.Unlock()
+
+	canceled := 0
+	for _, d := range running {
+		if _, err := dp.Backend.CancelPipeline(d.PipelineId); err != nil {
+			log.Errorf("Wasn't able to cancel pipeline %d of %s: %s", d.PipelineId, d.Client, err)
+			continue
+		}
+		log.Warnf("Pipeline %d of %s canceled", d.PipelineId, d.Client)
+		canceled++
+	}
+	return canceled
+}
+
+// notify calls OnUpdate if set
+func (dp *Deployer) notify(d *Deployment) {
+	if dp.OnUpdate != nil {
+		dp.OnUpdate(d)
+	}
+}
+
+func (dp *Deployer) track(d *Deployment) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	dp.running = append(dp.running, d)
+}
+
+func (dp *Deployer) untrack(d *Deployment) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	for i, r := range dp.running {
+		if r == d {
+			dp.running = append(dp.running[:i], dp.running[i+1:]...)
+			return
+		}
+	}
+}
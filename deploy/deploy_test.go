@@ -0,0 +1,307 @@
+package deploy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestDeployer returns a deployer on b polling without delay
+func newTestDeployer(b backend.Backend) *Deployer {
+	return New(b, Options{
+		Parallel:     2,
+		Timeout:      5 * time.Second,
+		JobsTimeout:  20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+}
+
+// failing returns a fake outcome failing the jobs of clients
+func failing(clients ...string) func(variables map[string]string, jobName string) string {
+	return func(variables map[string]string, jobName string) string {
+		if contains(clients, variables["client_id"]) {
+			return backend.StatusFailed
+		}
+		return backend.StatusSuccess
+	}
+}
+
+// statuses returns the status of every deployment by client
+func statuses(deployments []*Deployment) map[string]string {
+	result := make(map[string]string)
+	for _, d := range deployments {
+		result[d.Client] = d.Status
+	}
+	return result
+}
+
+func assertStatuses(t *testing.T, deployments []*Deployment, expected map[string]string) {
+	t.Helper()
+	got := statuses(deployments)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d deployments, got %v", len(expected), got)
+	}
+	for client, status := range expected {
+		if got[client] != status {
+			t.Errorf("expected status %s for %s, got %s", status, client, got[client])
+		}
+	}
+}
+
+func TestDeploySuccess(t *testing.T) {
+	fake := backend.NewFake("build", "deploy")
+	dp := newTestDeployer(fake)
+	spec := &Spec{App: "api", Ref: "v1.2", Variables: map[string]string{"ENV": "prod"}, Jobs: []string{"build", "deploy"}}
+
+	deployments := dp.Launch([]string{"acme", "globex"}, spec)
+	dp.Wait(deployments, true)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusSuccess, "globex": backend.StatusSuccess})
+	for _, d := range deployments {
+		if d.Error != nil {
+			t.Errorf("unexpected error for %s: %s", d.Client, d.Error)
+		}
+		if len(d.Jobs) != 2 || d.Jobs[0].Name != "build" || d.Jobs[1].Name != "deploy" {
+			t.Fatalf("expected jobs build and deploy to be played for %s, got %d jobs", d.Client, len(d.Jobs))
+		}
+		for _, job := range d.Jobs {
+			if job.Status != backend.StatusSuccess {
+				t.Errorf("expected job %s of %s to succeed, got %s", job.Name, d.Client, job.Status)
+			}
+		}
+	}
+
+	if len(fake.Triggers) != 2 {
+		t.Fatalf("expected 2 triggered pipelines, got %d", len(fake.Triggers))
+	}
+	for _, trigger := range fake.Triggers {
+		if trigger.Ref != "v1.2" {
+			t.Errorf("expected pipeline on ref v1.2, got %s", trigger.Ref)
+		}
+		if trigger.Variables["app_name"] != "api" || trigger.Variables["ENV"] != "prod" || trigger.Variables["client_id"] == "" {
+			t.Errorf("unexpected trigger variables %v", trigger.Variables)
+		}
+	}
+	if dp.Running() != 0 {
+		t.Errorf("expected no running deployment, got %d", dp.Running())
+	}
+}
+
+func TestDeployFailedOutcome(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	fake.Outcome = failing("globex")
+	dp := newTestDeployer(fake)
+
+	deployments := dp.Launch([]string{"acme", "globex"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, true)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusSuccess, "globex": backend.StatusFailed})
+	if failed := PrintSummary(ioutil.Discard, deployments); failed != 1 {
+		t.Errorf("expected 1 failed deployment in the summary, got %d", failed)
+	}
+}
+
+func TestDeployMissingJob(t *testing.T) {
+	fake := backend.NewFake("build")
+	dp := newTestDeployer(fake)
+
+	deployments := dp.Launch([]string{"acme"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, false)
+
+	d := deployments[0]
+	if d.Status != StatusError {
+		t.Fatalf("expected status %s, got %s", StatusError, d.Status)
+	}
+	if d.Error == nil || !strings.Contains(d.Error.Error(), "job deploy not found") || !strings.Contains(d.Error.Error(), "available jobs: build") {
+		t.Errorf("unexpected error %v", d.Error)
+	}
+	if len(d.Jobs) != 0 {
+		t.Errorf("expected no played job, got %d", len(d.Jobs))
+	}
+}
+
+func TestDeployNonManualJob(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	fake.Statuses = map[string]string{"deploy": backend.StatusRunning}
+	dp := newTestDeployer(fake)
+
+	deployments := dp.Launch([]string{"acme"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, false)
+
+	d := deployments[0]
+	if d.Status != StatusError {
+		t.Fatalf("expected status %s, got %s", StatusError, d.Status)
+	}
+	if d.Error == nil || !strings.Contains(d.Error.Error(), "its status is running instead of manual") {
+		t.Errorf("unexpected error %v", d.Error)
+	}
+}
+
+func TestDeployTriggerError(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	fake.Fail = func(method string, variables map[string]string) error {
+		if method == "TriggerPipeline" && variables["client_id"] == "globex" {
+			return errors.New("forbidden")
+		}
+		return nil
+	}
+	dp := newTestDeployer(fake)
+
+	deployments := dp.Launch([]string{"acme", "globex"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, true)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusSuccess, "globex": StatusError})
+	for _, d := range deployments {
+		if d.Client == "globex" && (d.Error == nil || d.PipelineId != 0 || d.Retryable) {
+			t.Errorf("expected a permanent error without pipeline for globex, got %v (pipeline %d)", d.Error, d.PipelineId)
+		}
+	}
+}
+
+func TestDeployWavesCanaryHalt(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	fake.Outcome = failing("acme")
+	dp := newTestDeployer(fake)
+	opts := WaveOptions{Canary: []string{"acme"}, MaxFailures: 5}
+	waves, err := PlanWaves([]string{"acme", "globex", "initech"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notified []string
+	dp.OnUpdate = func(d *Deployment) {
+		if d.Status == StatusHalted {
+			notified = append(notified, d.Client)
+		}
+	}
+	deployments := dp.DeployWaves(waves, &Spec{Ref: "master", Jobs: []string{"deploy"}}, opts)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusFailed, "globex": StatusHalted, "initech": StatusHalted})
+	if len(fake.Triggers) != 1 {
+		t.Errorf("expected only the canary to be triggered, got %d pipelines", len(fake.Triggers))
+	}
+	if strings.Join(notified, ",") != "globex,initech" {
+		t.Errorf("expected halted clients to be notified, got %v", notified)
+	}
+}
+
+func TestDeployWavesMaxFailures(t *testing.T) {
+	clients := []string{"acme", "globex", "initech", "umbrella"}
+	for _, test := range []struct {
+		maxFailures int
+		expected    map[string]string
+	}{
+		{1, map[string]string{"acme": backend.StatusFailed, "globex": backend.StatusFailed, "initech": StatusHalted, "umbrella": StatusHalted}},
+		{2, map[string]string{"acme": backend.StatusFailed, "globex": backend.StatusFailed, "initech": backend.StatusSuccess, "umbrella": backend.StatusSuccess}},
+	} {
+		fake := backend.NewFake("deploy")
+		fake.Outcome = failing("acme", "globex")
+		dp := newTestDeployer(fake)
+		opts := WaveOptions{BatchSize: 2, MaxFailures: test.maxFailures}
+		waves, err := PlanWaves(clients, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deployments := dp.DeployWaves(waves, &Spec{Ref: "master", Jobs: []string{"deploy"}}, opts)
+		assertStatuses(t, deployments, test.expected)
+	}
+}
+
+func TestStopHaltsClientsNotLaunched(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	dp := newTestDeployer(fake)
+	dp.Stop()
+
+	deployments := dp.DeployWaves([][]string{{"acme"}, {"globex"}}, &Spec{Ref: "master", Jobs: []string{"deploy"}}, WaveOptions{})
+
+	assertStatuses(t, deployments, map[string]string{"acme": StatusHalted, "globex": StatusHalted})
+	if len(fake.Triggers) != 0 {
+		t.Errorf("expected no triggered pipeline once stopped, got %d", len(fake.Triggers))
+	}
+}
+
+func TestCancelRunning(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	dp := newTestDeployer(fake)
+
+	deployments := dp.Launch([]string{"acme", "globex"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	if dp.Running() != 2 {
+		t.Fatalf("expected 2 running deployments, got %d", dp.Running())
+	}
+	if canceled := dp.CancelRunning(); canceled != 2 {
+		t.Fatalf("expected 2 canceled pipelines, got %d", canceled)
+	}
+	dp.Wait(deployments, true)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusCanceled, "globex": backend.StatusCanceled})
+	if dp.Running() != 0 {
+		t.Errorf("expected no running deployment after waiting, got %d", dp.Running())
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	dp := newTestDeployer(fake)
+	dp.Options.Timeout = 0
+
+	deployments := dp.Launch([]string{"acme"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, false)
+
+	assertStatuses(t, deployments, map[string]string{"acme": StatusTimeout})
+}
+
+func TestWaitJobError(t *testing.T) {
+	fake := backend.NewFake("deploy")
+	var mu sync.Mutex
+	unreachable := 3
+	fake.Fail = func(method string, variables map[string]string) error {
+		if method != "GetJob" {
+			return nil
+		}
+		switch variables["client_id"] {
+		case "acme":
+			return errors.New("404 Not found")
+		case "globex":
+			// GitLab can't be reached for a while
+			mu.Lock()
+			defer mu.Unlock()
+			if unreachable > 0 {
+				unreachable--
+				return &url.Error{Op: "Get", URL: "https://gitlab.example.com", Err: errors.New("connection refused")}
+			}
+		}
+		return nil
+	}
+	dp := newTestDeployer(fake)
+
+	start := time.Now()
+	deployments := dp.Launch([]string{"acme", "globex"}, &Spec{Ref: "master", Jobs: []string{"deploy"}})
+	dp.Wait(deployments, true)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a permanent error to end the wait at once, waited %s", elapsed)
+	}
+	assertStatuses(t, deployments, map[string]string{"acme": StatusError, "globex": backend.StatusSuccess})
+	for _, d := range deployments {
+		if d.Client == "acme" && (d.Error == nil || !strings.Contains(d.Error.Error(), "wasn't able to get status of job") || d.Retryable) {
+			t.Errorf("expected a permanent error getting the job of acme, got %v", d.Error)
+		}
+		if d.Client == "globex" && d.Error != nil {
+			t.Errorf("expected transient errors to be retried for globex, got %v", d.Error)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package deploy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	log "github.com/sirupsen/logrus"
+)
+
+// WaitJobs lists jobs of a pipeline until every requested job appears in it.
+// A freshly triggered pipeline may take some time to create its jobs.
+func (dp *Deployer) WaitJobs(pipelineId int, jobNames []string) ([]*backend.Job, error) {
+	deadline := time.Now().Add(dp.Options.JobsTimeout)
+	for {
+		jobs, err := dp.Backend.ListJobs(pipelineId)
+		if err != nil {
+			return nil, fmt.Errorf("wasn't able to list jobs from pipeline %s: %w", strconv.Itoa(pipelineId), err)
+		}
+		missing := ""
+		for _, jobName := range jobNames {
+			if FindJob(jobs, jobName) == nil {
+				missing = jobName
+				break
+			}
+		}
+		if missing == "" {
+			return jobs, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("job %s not found in pipeline %s, available jobs: %s", missing, strconv.Itoa(pipelineId), jobNamesList(jobs))
+		}
+		log.Debugf("Job %s not found yet in pipeline %s, next check in %s", missing, strconv.Itoa(pipelineId), dp.Options.PollInterval)
+		time.Sleep(dp.Options.PollInterval)
+	}
+}
+
+// FindJob returns the most recent job called jobName, nil if there is none
+func FindJob(jobs []*backend.Job, jobName string) *backend.Job {
+	var found *backend.Job
+	for _, job := range jobs {
+		if job.Name == jobName && (found == nil || job.Id > found.Id) {
+			found = job
+		}
+	}
+	return found
+}
+
+// jobNamesList returns the distinct job names of a pipeline separated by commas
+func jobNamesList(jobs []*backend.Job) string {
+	var names []string
+	for _, job := range jobs {
+		if !contains(names, job.Name) {
+			names = append(names, job.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// RunJob plays a job from a job name, the job has to be a manual one
+func (dp *Deployer) RunJob(pipelineId int, jobs []*backend.Job, jobName string, args []string) (int, error) {
+	// Get job ID
+	job := FindJob(jobs, jobName)
+	if job == nil {
+		return 0, fmt.Errorf("job %s not found in pipeline %s, available jobs: %s", jobName, strconv.Itoa(pipelineId), jobNamesList(jobs))
+	}
+	if job.Status != backend.StatusManual {
+		return 0, fmt.Errorf("job %s id %s on pipeline %s can't be played, its status is %s instead of %s", jobName, strconv.Itoa(job.Id), strconv.Itoa(pipelineId), job.Status, backend.StatusManual)
+	}
+	jobId := job.Id
+
+	// Play job
+	if _, err := dp.Backend.PlayJob(jobId); err != nil {
+		return 0, fmt.Errorf("wasn't able to play job %s id %s on pipeline %s: %w", jobName, strconv.Itoa(jobId), strconv.Itoa(pipelineId), err)
+	}
+	if len(args) == 2 {
+		log.Infof("Job successfully been launched (%s/%s)", args[0], args[1])
+	} else {
+		log.Infof("Job successfully been launched (%s)", args[0])
+	}
+	log.Infof("Job progression: %s", dp.Backend.JobURL(jobId))
+
+	return jobId, nil
+}
+
+// WaitJob polls a played job and its pipeline until one of them reaches a terminal state
+// or the deadline is exceeded. The final job status is returned.
+// Transient errors are retried until the deadline, other ones (job not found, forbidden...) end the wait with
+// StatusError and the error.
+// When trace is set, new lines of the job trace are printed at each check.
+func (dp *Deployer) WaitJob(pipelineId int, jobId int, deadline time.Time, trace *jobTrace) (string, error) {
+	if trace != nil {
+		defer trace.flush()
+	}
+	for {
+		job, err := dp.Backend.GetJob(jobId)
+		if trace != nil {
+			dp.followTrace(jobId, trace)
+		}
+		if err != nil {
+			if !backend.IsRetryable(err) {
+				return StatusError, fmt.Errorf("wasn't able to get status of job id %s: %w", strconv.Itoa(jobId), err)
+			}
+			log.Warnf("Wasn't able to get status of job id %s: %s", strconv.Itoa(jobId), err)
+		} else if backend.IsTerminal(job.Status) {
+			return job.Status, nil
+		}
+
+		// A canceled or failed pipeline may leave the job in a non terminal state
+		pipeline, err := dp.Backend.GetPipeline(pipelineId)
+		if err != nil {
+			if !backend.IsRetryable(err) {
+				return StatusError, fmt.Errorf("wasn't able to get status of pipeline %s: %w", strconv.Itoa(pipelineId), err)
+			}
+			log.Warnf("Wasn't able to get status of pipeline %s: %s", strconv.Itoa(pipelineId), err)
+		} else if backend.IsTerminal(pipeline.Status) && pipeline.Status != backend.StatusSuccess {
+			return pipeline.Status, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return StatusTimeout, nil
+		}
+		log.Debugf("Job %s is still running, next check in %s", strconv.Itoa(jobId), dp.Options.PollInterval)
+		time.Sleep(dp.Options.PollInterval)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/MySocialApp/msa-deployer/audit"
+)
+
+// PrintSummary writes a table with the final state of every client and returns the count of clients
+// which haven't been deployed successfully
+func PrintSummary(out io.Writer, deployments []*Deployment) int {
+	failed, halted := 0, 0
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tPIPELINE\tJOB\tSTATUS\tDETAILS")
+	for _, d := range deployments {
+		details := ""
+		if d.Error != nil {
+			details = d.Error.Error() + " (permanent)"
+			if d.Retryable {
+				details = d.Error.Error() + " (retryable)"
+			}
+		}
+		if d.Status == StatusHalted {
+			halted++
+		} else if !d.Succeeded() {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Client, IdOrDash(d.PipelineId), d.JobIds(), d.Status, details)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\n%d succeeded, %d failed", len(deployments)-failed-halted, failed)
+	if halted > 0 {
+		fmt.Fprintf(out, ", %d not deployed", halted)
+	}
+	fmt.Fprintln(out)
+
+	return failed + halted
+}
+
+// IdOrDash returns a GitLab id, or a dash when there is none
+func IdOrDash(id int) string {
+	if id == 0 {
+		return "-"
+	}
+	return strconv.Itoa(id)
+}
+
+// PlannedPipeline describes a pipeline a deploy would trigger, and the job it would play
+type PlannedPipeline struct {
+	Wave      int               `json:"wave"`
+	Client    string            `json:"client_id"`
+	Project   string            `json:"project"`
+	Ref       string            `json:"ref"`
+	Variables map[string]string `json:"variables"`
+	Jobs      []string          `json:"jobs"`
+}
+
+// Plan resolves what would be triggered for every client on project, without calling the backend. Values of secret
+// variables are redacted since the plan is printed
+func Plan(waves [][]string, spec *Spec, project string) []PlannedPipeline {
+	var plan []PlannedPipeline
+	for i, wave := range waves {
+		for _, clientName := range wave {
+			plan = append(plan, PlannedPipeline{
+				Wave:      i + 1,
+				Client:    clientName,
+				Project:   project,
+				Ref:       spec.Ref,
+				Variables: audit.Redact(spec.TriggerVariables(clientName)),
+				Jobs:      spec.Jobs,
+			})
+		}
+	}
+	return plan
+}
+
+// PrintPlan writes the plan as a table or as JSON
+func PrintPlan(out io.Writer, plan []PlannedPipeline, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	case "table":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "WAVE\tCLIENT\tPROJECT\tREF\tJOBS\tVARIABLES")
+		for _, p := range plan {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", p.Wave, p.Client, p.Project, p.Ref, strings.Join(p.Jobs, ","), FormatVariables(p.Variables))
+		}
+		w.Flush()
+		fmt.Fprintf(out, "\n%d pipeline(s) would be triggered\n", len(plan))
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q (table or json)", format)
+}
+
+// FormatVariables returns variables as sorted key=value pairs
+func FormatVariables(variables map[string]string) string {
+	pairs := make([]string, 0, len(variables))
+	for key, value := range variables {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
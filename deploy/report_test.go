@@ -0,0 +1,63 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPrintPlanRedactsSecrets(t *testing.T) {
+	spec := &Spec{
+		Ref:             "master",
+		App:             "api",
+		Jobs:            []string{"deploy"},
+		Variables:       map[string]string{"ENV": "production", "API_TOKEN": "t0k3n"},
+		ClientVariables: map[string]map[string]string{"acme": {"db_password": "hunter2"}},
+		Overrides:       map[string]string{"PRIVATE_KEY": "-----BEGIN"},
+	}
+	plan := Plan([][]string{{"acme"}, {"globex"}}, spec, "deploy")
+
+	var table bytes.Buffer
+	if err := PrintPlan(&table, plan, "table"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`1\s+acme\s+deploy\s+master\s+deploy\s+API_TOKEN=\[redacted\] ENV=production PRIVATE_KEY=\[redacted\] app_name=api client_id=acme db_password=\[redacted\]\n`,
+		`2\s+globex\s+deploy\s+master\s+deploy\s+API_TOKEN=\[redacted\] ENV=production PRIVATE_KEY=\[redacted\] app_name=api client_id=globex\n`,
+		`2 pipeline\(s\) would be triggered`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(table.String()) {
+			t.Errorf("expected the plan to match %q:\n%s", expected, table.String())
+		}
+	}
+
+	var output bytes.Buffer
+	if err := PrintPlan(&output, plan, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var printed []PlannedPipeline
+	if err := json.Unmarshal(output.Bytes(), &printed); err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) != 2 || printed[0].Client != "acme" || printed[0].Variables["db_password"] != "[redacted]" ||
+		printed[0].Variables["API_TOKEN"] != "[redacted]" || printed[1].Variables["ENV"] != "production" {
+		t.Errorf("unexpected JSON plan %+v", printed)
+	}
+
+	for _, plain := range []string{"t0k3n", "hunter2", "BEGIN"} {
+		if strings.Contains(table.String(), plain) || strings.Contains(output.String(), plain) {
+			t.Errorf("expected %q to be redacted:\n%s\n%s", plain, table.String(), output.String())
+		}
+	}
+	if spec.Variables["API_TOKEN"] != "t0k3n" {
+		t.Error("expected the spec to keep the secret for the trigger")
+	}
+}
+
+func TestPrintPlanUnknownFormat(t *testing.T) {
+	if err := PrintPlan(&bytes.Buffer{}, nil, "yaml"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
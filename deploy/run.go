@@ -0,0 +1,267 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+	log "github.com/sirupsen/logrus"
+)
+
+// Run is the state of a deploy run, saved after every change of its deployments so an interrupted run can be resumed
+type Run struct {
+	Id          string       `json:"id"`
+	Time        time.Time    `json:"time"`
+	Operator    string       `json:"operator,omitempty"`
+	Command     string       `json:"command,omitempty"`
+	Spec        *Spec        `json:"spec"`
+	Waves       [][]string   `json:"waves"`
+	Canary      bool         `json:"canary,omitempty"`
+	MaxFailures int          `json:"max_failures,omitempty"`
+	Clients     []*RunClient `json:"clients"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// RunClient is the state of the deployment of a client in a run, a client which hasn't been launched has no status
+type RunClient struct {
+	Client     string       `json:"client_id"`
+	PipelineId int          `json:"pipeline_id,omitempty"`
+	Jobs       []*PlayedJob `json:"jobs,omitempty"`
+	Status     string       `json:"status,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Retryable  bool         `json:"retryable,omitempty"`
+}
+
+// NewRun returns the state of a new run deploying waves, saved in dir. Its id is made from the current time
+func NewRun(dir string, spec *Spec, waves [][]string, opts WaveOptions) *Run {
+	now := time.Now().UTC()
+	run := &Run{Time: now, Spec: spec, Waves: waves, Canary: opts.hasCanary(), MaxFailures: opts.MaxFailures}
+	run.Id = now.Format("20060102-150405")
+	for i := 2; ; i++ {
+		run.path = filepath.Join(dir, run.Id+".json")
+		if _, err := os.Stat(run.path); os.IsNotExist(err) {
+			break
+		}
+		run.Id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+	for _, wave := range waves {
+		for _, clientName := range wave {
+			run.Clients = append(run.Clients, &RunClient{Client: clientName})
+		}
+	}
+	return run
+}
+
+// LoadRun reads the state of the run id saved in dir
+func LoadRun(dir string, id string) (*Run, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid run id %q", id)
+	}
+	path := filepath.Join(dir, id+".json")
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("run %s not found in %s", id, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var run Run
+	if err := json.Unmarshal(content, &run); err != nil {
+		return nil, fmt.Errorf("wasn't able to read run %s: %s", path, err)
+	}
+	if run.Spec == nil {
+		return nil, fmt.Errorf("run %s has no deploy spec", path)
+	}
+	run.path = path
+	return &run, nil
+}
+
+// Path returns where the run state is saved
+func (r *Run) Path() string {
+	return r.path
+}
+
+// Save writes the run state, it may contain secret variables so only the owner can read it
+func (r *Run) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save()
+}
+
+func (r *Run) save() error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// Update records the state of a deployment and saves the run
+func (r *Run) Update(d *Deployment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.Clients {
+		if c.Client != d.Client {
+			continue
+		}
+		c.PipelineId = d.PipelineId
+		c.Status = d.Status
+		c.Error = ""
+		c.Retryable = d.Retryable
+		if d.Error != nil {
+			c.Error = d.Error.Error()
+		}
+		c.Jobs = nil
+		for _, job := range d.Jobs {
+			copied := *job
+			c.Jobs = append(c.Jobs, &copied)
+		}
+		return r.save()
+	}
+	return fmt.Errorf("client %s is not part of run %s", d.Client, r.Id)
+}
+
+// Deployments returns the deployments of the run clients as they have been saved
+func (r *Run) Deployments() []*Deployment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deployments := make([]*Deployment, len(r.Clients))
+	for i, c := range r.Clients {
+		d := &Deployment{Client: c.Client, PipelineId: c.PipelineId, Status: c.Status, Retryable: c.Retryable}
+		if c.Error != "" {
+			d.Error = errors.New(c.Error)
+		}
+		for _, job := range c.Jobs {
+			copied := *job
+			d.Jobs = append(d.Jobs, &copied)
+		}
+		deployments[i] = d
+	}
+	return deployments
+}
+
+// Resume continues an interrupted run: succeeded clients are skipped, deployments whose pipeline had been triggered
+// are resumed in that pipeline, then the other clients are deployed again in their waves. Clients whose pipeline is
+// still running aren't deployed again, so that a client never has two deployments at once.
+// It returns the final deployment of every client of the run.
+func (dp *Deployer) Resume(run *Run) []*Deployment {
+	deployments := run.Deployments()
+	var triggered []*Deployment
+	for _, d := range deployments {
+		if d.PipelineId != 0 && !d.Succeeded() {
+			triggered = append(triggered, d)
+		}
+	}
+	if len(triggered) > 0 {
+		log.Infof("Resuming %d deployment(s) in the pipelines they were triggered in", len(triggered))
+		dp.resumePipelines(triggered, run.Spec)
+	}
+
+	final := make(map[string]*Deployment)
+	done := 0
+	for _, d := range deployments {
+		final[d.Client] = d
+		if d.Succeeded() {
+			done++
+		}
+	}
+	var waves [][]string
+	opts := WaveOptions{MaxFailures: run.MaxFailures}
+	for i, wave := range run.Waves {
+		var remaining []string
+		for _, clientName := range wave {
+			d := final[clientName]
+			if d == nil || d.Succeeded() {
+				continue
+			}
+			if d.Status == StatusTimeout {
+				log.Warnf("Pipeline %d of %s is still running, %s isn't deployed again", d.PipelineId, clientName, clientName)
+				continue
+			}
+			remaining = append(remaining, clientName)
+		}
+		if len(remaining) == 0 {
+			continue
+		}
+		// The canary wave keeps its zero failure threshold when some of its clients are left
+		if i == 0 && run.Canary {
+			opts.Canary = remaining
+		}
+		waves = append(waves, remaining)
+	}
+	log.Infof("Run %s: %d client(s) already deployed, %d left", run.Id, done, len(deployments)-done)
+
+	for _, d := range dp.DeployWaves(waves, run.Spec, opts) {
+		final[d.Client] = d
+	}
+	for i, d := range deployments {
+		deployments[i] = final[d.Client]
+	}
+	return deployments
+}
+
+// resumePipelines continues deployments in the pipelines an interrupted run triggered: jobs which may still be running
+// are waited for, then the jobs left are played in the same pipeline if the previous ones succeeded. Deployments
+// whose jobs failed are left to be deployed again, the ones whose jobs are still running end with the timeout status
+func (dp *Deployer) resumePipelines(deployments []*Deployment, spec *Spec) {
+	var running []*Deployment
+	for _, d := range deployments {
+		d.Status, d.Error, d.Retryable = "", nil, false
+		for _, job := range d.Jobs {
+			if !backend.IsTerminal(job.Status) {
+				running = append(running, d)
+				dp.track(d)
+				break
+			}
+		}
+	}
+	dp.Wait(running, true)
+
+	var left []*Deployment
+	for _, d := range deployments {
+		if d.Status == StatusTimeout {
+			continue
+		}
+		if status := d.failedJobStatus(); status != "" {
+			d.Status = status
+			continue
+		}
+		if len(d.Jobs) == len(spec.Jobs) {
+			d.Status = backend.StatusSuccess
+			continue
+		}
+		left = append(left, d)
+	}
+	dp.each(left, func(d *Deployment) {
+		dp.track(d)
+		dp.playJobs(d, spec)
+	})
+	dp.Wait(left, true)
+}
+
+// failedJobStatus returns the status of the first job played in the deployment which ended without succeeding,
+// empty if there is none
+func (d *Deployment) failedJobStatus() string {
+	for _, job := range d.Jobs {
+		if backend.IsTerminal(job.Status) && job.Status != backend.StatusSuccess {
+			return job.Status
+		}
+	}
+	return ""
+}
@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+)
+
+func TestRunSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	spec := &Spec{App: "api", Ref: "master", Overrides: map[string]string{"API_TOKEN": "secret"}, Jobs: []string{"deploy"}}
+	opts := WaveOptions{Canary: []string{"acme"}, MaxFailures: 1}
+	run := NewRun(dir, spec, [][]string{{"acme"}, {"globex"}}, opts)
+	run.Operator = "jane"
+	if err := run.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Update(&Deployment{Client: "acme", PipelineId: 12, Jobs: []*PlayedJob{{Name: "deploy", Id: 13}}, Status: backend.StatusSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Update(&Deployment{Client: "unknown"}); err == nil {
+		t.Error("expected an error updating a client which isn't part of the run")
+	}
+
+	info, err := os.Stat(run.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected run state to be readable by its owner only, got %s", info.Mode().Perm())
+	}
+
+	loaded, err := LoadRun(dir, run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Operator != "jane" || !loaded.Canary || loaded.MaxFailures != 1 || loaded.Spec.Overrides["API_TOKEN"] != "secret" {
+		t.Errorf("run settings not kept: %+v", loaded)
+	}
+	deployments := loaded.Deployments()
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusSuccess, "globex": ""})
+	if deployments[0].PipelineId != 12 || deployments[0].JobIds() != "13" {
+		t.Errorf("unexpected saved deployment of acme: pipeline %d, jobs %s", deployments[0].PipelineId, deployments[0].JobIds())
+	}
+
+	if _, err := LoadRun(dir, "../etc/passwd"); err == nil {
+		t.Error("expected an invalid run id to be rejected")
+	}
+	if _, err := LoadRun(dir, "20000101-000000"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a missing run not to be found, got %v", err)
+	}
+}
+
+func TestRunSavedOnUpdate(t *testing.T) {
+	dir := t.TempDir()
+	fake := backend.NewFake("deploy")
+	fake.Outcome = failing("globex")
+	dp := newTestDeployer(fake)
+	spec := &Spec{Ref: "master", Jobs: []string{"deploy"}}
+	waves := [][]string{{"acme", "globex"}}
+	run := NewRun(dir, spec, waves, WaveOptions{})
+	dp.OnUpdate = func(d *Deployment) {
+		if err := run.Update(d); err != nil {
+			t.Error(err)
+		}
+	}
+
+	dp.DeployWaves(waves, spec, WaveOptions{})
+
+	loaded, err := LoadRun(dir, run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(t, loaded.Deployments(), map[string]string{"acme": backend.StatusSuccess, "globex": backend.StatusFailed})
+}
+
+func TestResumeSkipsSucceededClients(t *testing.T) {
+	dir := t.TempDir()
+	fake := backend.NewFake("deploy")
+	dp := newTestDeployer(fake)
+	spec := &Spec{Ref: "master", Jobs: []string{"deploy"}}
+	run := NewRun(dir, spec, [][]string{{"acme"}, {"globex", "initech", "umbrella"}}, WaveOptions{Canary: []string{"acme"}})
+
+	// initech was in flight when the run has been interrupted, umbrella was never launched
+	pipeline, err := fake.TriggerPipeline("master", spec.TriggerVariables("initech"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := fake.ListJobs(pipeline.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PlayJob(jobs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*Deployment{
+		{Client: "acme", PipelineId: 100, Jobs: []*PlayedJob{{Name: "deploy", Id: 101, Status: backend.StatusSuccess}}, Status: backend.StatusSuccess},
+		{Client: "globex", PipelineId: 200, Jobs: []*PlayedJob{{Name: "deploy", Id: 201, Status: backend.StatusFailed}}, Status: backend.StatusFailed},
+		{Client: "initech", PipelineId: pipeline.Id, Jobs: []*PlayedJob{{Name: "deploy", Id: jobs[0].Id}}},
+	} {
+		if err := run.Update(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deployments := dp.Resume(run)
+
+	assertStatuses(t, deployments, map[string]string{
+		"acme": backend.StatusSuccess, "globex": backend.StatusSuccess, "initech": backend.StatusSuccess, "umbrella": backend.StatusSuccess,
+	})
+	var triggered []string
+	for _, trigger := range fake.Triggers[1:] {
+		triggered = append(triggered, trigger.Variables["client_id"])
+	}
+	if strings.Join(triggered, ",") != "globex,umbrella" {
+		t.Errorf("expected only globex and umbrella to be deployed again, got %v", triggered)
+	}
+	for _, d := range deployments {
+		if d.Client == "initech" && d.PipelineId != pipeline.Id {
+			t.Errorf("expected the in-flight pipeline of initech to be waited for, got pipeline %d", d.PipelineId)
+		}
+	}
+}
+
+func TestResumePartiallyPlayedPipeline(t *testing.T) {
+	dir := t.TempDir()
+	fake := backend.NewFake("migrate", "deploy")
+	dp := newTestDeployer(fake)
+	spec := &Spec{Ref: "master", Jobs: []string{"migrate", "deploy"}}
+	run := NewRun(dir, spec, [][]string{{"acme", "globex", "initech"}}, WaveOptions{})
+
+	// The run has been interrupted after playing migrate for acme, and before playing any job for globex
+	trigger := func(client string) (int, []*backend.Job) {
+		pipeline, err := fake.TriggerPipeline("master", spec.TriggerVariables(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := fake.ListJobs(pipeline.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pipeline.Id, jobs
+	}
+	acmePipeline, acmeJobs := trigger("acme")
+	if _, err := fake.PlayJob(acmeJobs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	globexPipeline, _ := trigger("globex")
+	for _, d := range []*Deployment{
+		{Client: "acme", PipelineId: acmePipeline, Jobs: []*PlayedJob{{Name: "migrate", Id: acmeJobs[0].Id}}, Status: StatusError, Error: errors.New("interrupted")},
+		{Client: "globex", PipelineId: globexPipeline, Status: StatusHalted},
+	} {
+		if err := run.Update(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deployments := dp.Resume(run)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusSuccess, "globex": backend.StatusSuccess, "initech": backend.StatusSuccess})
+	if len(fake.Triggers) != 3 || fake.Triggers[2].Variables["client_id"] != "initech" {
+		t.Fatalf("expected only initech to get a new pipeline, got %d pipelines", len(fake.Triggers))
+	}
+	for _, d := range deployments {
+		expected := map[string]int{"acme": acmePipeline, "globex": globexPipeline}[d.Client]
+		if expected != 0 && (d.PipelineId != expected || len(d.Jobs) != 2) {
+			t.Errorf("expected %s to play both jobs in pipeline %d, got jobs %s in pipeline %d", d.Client, expected, d.JobIds(), d.PipelineId)
+		}
+	}
+	if d := deployments[0]; d.Jobs[0].Id != acmeJobs[0].Id {
+		t.Errorf("expected migrate of acme not to be played again, got job %d", d.Jobs[0].Id)
+	}
+}
+
+func TestResumeStillRunningPipeline(t *testing.T) {
+	dir := t.TempDir()
+	fake := backend.NewFake("deploy")
+	fake.Outcome = func(map[string]string, string) string { return backend.StatusRunning }
+	dp := newTestDeployer(fake)
+	dp.Options.Timeout = 20 * time.Millisecond
+	spec := &Spec{Ref: "master", Jobs: []string{"deploy"}}
+	run := NewRun(dir, spec, [][]string{{"acme"}}, WaveOptions{})
+	pipeline, err := fake.TriggerPipeline("master", spec.TriggerVariables("acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := fake.ListJobs(pipeline.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PlayJob(jobs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Update(&Deployment{Client: "acme", PipelineId: pipeline.Id, Jobs: []*PlayedJob{{Name: "deploy", Id: jobs[0].Id, Status: StatusTimeout}}, Status: StatusTimeout}); err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := dp.Resume(run)
+
+	assertStatuses(t, deployments, map[string]string{"acme": StatusTimeout})
+	if len(fake.Triggers) != 1 {
+		t.Errorf("expected acme not to be deployed again while its pipeline is running, got %d pipelines", len(fake.Triggers))
+	}
+}
+
+func TestResumeKeepsCanaryThreshold(t *testing.T) {
+	dir := t.TempDir()
+	fake := backend.NewFake("deploy")
+	fake.Outcome = failing("acme")
+	dp := newTestDeployer(fake)
+	spec := &Spec{Ref: "master", Jobs: []string{"deploy"}}
+	run := NewRun(dir, spec, [][]string{{"acme"}, {"globex"}}, WaveOptions{Canary: []string{"acme"}, MaxFailures: 3})
+
+	deployments := dp.Resume(run)
+
+	assertStatuses(t, deployments, map[string]string{"acme": backend.StatusFailed, "globex": StatusHalted})
+}
@@ -0,0 +1,83 @@
+package deploy
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TraceWriter serializes lines coming from several job traces, so only complete lines are written
+type TraceWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewTraceWriter returns a trace writer printing to out
+func NewTraceWriter(out io.Writer) *TraceWriter {
+	return &TraceWriter{out: out}
+}
+
+// writeLine writes a single line with its prefix
+func (w *TraceWriter) writeLine(prefix string, line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.out.Write(append([]byte(prefix), line...))
+}
+
+// jobTrace follows the trace of a job and keeps track of what has already been printed
+type jobTrace struct {
+	prefix  string
+	offset  int
+	pending []byte
+	writer  *TraceWriter
+}
+
+// newJobTrace prepares a trace follower, lines are prefixed by label when several jobs are followed
+func (w *TraceWriter) newJobTrace(label string, prefixed bool) *jobTrace {
+	trace := &jobTrace{writer: w}
+	if prefixed {
+		trace.prefix = "[" + label + "] "
+	}
+	return trace
+}
+
+// write buffers new trace bytes and prints every completed line
+func (t *jobTrace) write(data []byte) {
+	t.pending = append(t.pending, data...)
+	for {
+		i := bytes.IndexByte(t.pending, '\n')
+		if i < 0 {
+			return
+		}
+		t.writer.writeLine(t.prefix, t.pending[:i+1])
+		t.pending = t.pending[i+1:]
+	}
+}
+
+// flush prints the last line even if it's not terminated
+func (t *jobTrace) flush() {
+	if len(t.pending) > 0 {
+		t.writer.writeLine(t.prefix, append(t.pending, '\n'))
+		t.pending = nil
+	}
+}
+
+// followTrace gets the job trace and prints what has been added since the last call
+func (dp *Deployer) followTrace(jobId int, trace *jobTrace) {
+	data, err := dp.Backend.GetTrace(jobId)
+	if err != nil {
+		log.Warnf("Wasn't able to get trace of job id %s: %s", strconv.Itoa(jobId), err)
+		return
+	}
+
+	// The trace has been reset (job retried), start over
+	if len(data) < trace.offset {
+		trace.offset = 0
+		trace.pending = nil
+	}
+	trace.write(data[trace.offset:])
+	trace.offset = len(data)
+}
@@ -0,0 +1,124 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MySocialApp/msa-deployer/backend"
+)
+
+// chunkedTraces serves job traces growing by a chunk at every call
+type chunkedTraces struct {
+	backend.Backend
+
+	mu     sync.Mutex
+	chunks map[int][]string
+	calls  map[int]int
+}
+
+func (c *chunkedTraces) GetTrace(jobId int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[jobId]++
+	n := c.calls[jobId]
+	if n > len(c.chunks[jobId]) {
+		n = len(c.chunks[jobId])
+	}
+	return []byte(strings.Join(c.chunks[jobId][:n], "")), nil
+}
+
+// split cuts trace every size bytes, regardless of line ends
+func split(trace string, size int) []string {
+	var chunks []string
+	for len(trace) > size {
+		chunks = append(chunks, trace[:size])
+		trace = trace[size:]
+	}
+	return append(chunks, trace)
+}
+
+func TestFollowTracePrefixesWholeLines(t *testing.T) {
+	clients := []string{"acme", "globex"}
+	traces := &chunkedTraces{chunks: make(map[int][]string), calls: make(map[int]int)}
+	for i, client := range clients {
+		var trace string
+		for step := 1; step <= 20; step++ {
+			trace += fmt.Sprintf("%s step %d\n", client, step)
+		}
+		// The job is still running, its last line isn't terminated
+		traces.chunks[i+1] = split(trace+client+" running", 7+i*4)
+	}
+	var out bytes.Buffer
+	dp := newTestDeployer(traces)
+	dp.Traces = NewTraceWriter(&out)
+
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(jobId int, client string) {
+			defer wg.Done()
+			trace := dp.Traces.newJobTrace(client, true)
+			for range traces.chunks[jobId] {
+				dp.followTrace(jobId, trace)
+			}
+			trace.flush()
+		}(i+1, client)
+	}
+	wg.Wait()
+
+	lines := make(map[string][]string)
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		var client string
+		for _, c := range clients {
+			if strings.HasPrefix(line, "["+c+"] "+c+" ") {
+				client = c
+			}
+		}
+		if client == "" || !strings.HasSuffix(line, "\n") {
+			t.Fatalf("expected a whole line prefixed by its client, got %q in:\n%s", line, out.String())
+		}
+		lines[client] = append(lines[client], strings.TrimPrefix(line, "["+client+"] "))
+	}
+	for _, client := range clients {
+		if len(lines[client]) != 21 {
+			t.Fatalf("expected 21 lines for %s, got %d:\n%s", client, len(lines[client]), out.String())
+		}
+		for step, line := range lines[client][:20] {
+			if expected := fmt.Sprintf("%s step %d\n", client, step+1); line != expected {
+				t.Errorf("expected line %q of %s, got %q", expected, client, line)
+			}
+		}
+		if last := lines[client][20]; last != client+" running\n" {
+			t.Errorf("expected the unterminated line of %s to be flushed, got %q", client, last)
+		}
+	}
+}
+
+func TestFollowTraceStartsOverWhenReset(t *testing.T) {
+	traces := &chunkedTraces{
+		chunks: map[int][]string{1: {"first run\nfai", "led\n"}},
+		calls:  make(map[int]int),
+	}
+	var out bytes.Buffer
+	dp := newTestDeployer(traces)
+	dp.Traces = NewTraceWriter(&out)
+	trace := dp.Traces.newJobTrace("acme", false)
+
+	dp.followTrace(1, trace)
+	dp.followTrace(1, trace)
+	// The job has been retried, its trace is shorter
+	traces.chunks[1] = []string{"second", " run\n"}
+	traces.calls[1] = 0
+	dp.followTrace(1, trace)
+	dp.followTrace(1, trace)
+
+	if expected := "first run\nfailed\nsecond run\n"; out.String() != expected {
+		t.Errorf("expected trace %q, got %q", expected, out.String())
+	}
+}
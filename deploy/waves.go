@@ -0,0 +1,128 @@
+package deploy
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WaveOptions describes how clients are split in waves
+type WaveOptions struct {
+	Canary        []string
+	CanaryPercent int
+	BatchSize     int
+	MaxFailures   int
+}
+
+// hasCanary tells if the first wave is a canary one
+func (o WaveOptions) hasCanary() bool {
+	return len(o.Canary) > 0 || o.CanaryPercent > 0
+}
+
+// PlanWaves splits clients in waves: canary clients first, then the others by batches of BatchSize.
+// Without canary nor batch size, every client is deployed in a single wave.
+func PlanWaves(clients []string, opts WaveOptions) ([][]string, error) {
+	if len(opts.Canary) > 0 && opts.CanaryPercent > 0 {
+		return nil, fmt.Errorf("canary clients and canary percentage can't be used together")
+	}
+	if opts.CanaryPercent < 0 || opts.CanaryPercent > 100 {
+		return nil, fmt.Errorf("canary percentage must be between 1 and 100, got %d", opts.CanaryPercent)
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("batch size can't be negative, got %d", opts.BatchSize)
+	}
+
+	var waves [][]string
+	remaining := clients
+
+	if len(opts.Canary) > 0 {
+		canary := make(map[string]bool)
+		for _, clientName := range opts.Canary {
+			if !contains(clients, clientName) {
+				return nil, fmt.Errorf("canary client %s is not part of the deployed clients", clientName)
+			}
+			canary[clientName] = true
+		}
+		remaining = nil
+		var wave []string
+		for _, clientName := range clients {
+			if canary[clientName] {
+				wave = append(wave, clientName)
+			} else {
+				remaining = append(remaining, clientName)
+			}
+		}
+		waves = append(waves, wave)
+	} else if opts.CanaryPercent > 0 {
+		size := (len(clients)*opts.CanaryPercent + 99) / 100
+		if size < 1 {
+			size = 1
+		}
+		waves = append(waves, clients[:size])
+		remaining = clients[size:]
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize == 0 {
+		batchSize = len(remaining)
+	}
+	for len(remaining) > 0 {
+		if batchSize > len(remaining) {
+			batchSize = len(remaining)
+		}
+		waves = append(waves, remaining[:batchSize])
+		remaining = remaining[batchSize:]
+	}
+
+	return waves, nil
+}
+
+// DeployWaves deploys waves one after the other, waiting for a wave to end before starting the next one.
+// Deployment halts when a canary fails or when a wave has more than MaxFailures failed clients.
+func (dp *Deployer) DeployWaves(waves [][]string, spec *Spec, opts WaveOptions) []*Deployment {
+	var deployments []*Deployment
+	total := 0
+	for _, wave := range waves {
+		total += len(wave)
+	}
+
+	for i, wave := range waves {
+		if len(waves) > 1 {
+			log.Infof("Deploying wave %d/%d (%d clients)", i+1, len(waves), len(wave))
+		}
+		launched := dp.Launch(wave, spec)
+		dp.Wait(launched, total > 1)
+		deployments = append(deployments, launched...)
+
+		failed := 0
+		for _, d := range launched {
+			if !d.Succeeded() {
+				failed++
+			}
+		}
+		threshold := opts.MaxFailures
+		if i == 0 && opts.hasCanary() {
+			threshold = 0
+		}
+		if i == len(waves)-1 {
+			break
+		}
+		if dp.Stopped() {
+			log.Warnf("Deployment interrupted, %d wave(s) left undeployed", len(waves)-i-1)
+		} else if failed > threshold {
+			log.Errorf("Wave %d/%d has %d failed client(s) (threshold %d), halting deployment", i+1, len(waves), failed, threshold)
+		} else {
+			continue
+		}
+		for _, next := range waves[i+1:] {
+			for _, clientName := range next {
+				halted := &Deployment{Client: clientName, Status: StatusHalted}
+				dp.notify(halted)
+				deployments = append(deployments, halted)
+			}
+		}
+		break
+	}
+
+	return deployments
+}
@@ -0,0 +1,87 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleGuard is the age after which the guard file of an update is considered left by a dead process
+const staleGuard = time.Minute
+
+// FileStore keeps locks in a local file, updates being guarded by a .guard file created next to it
+type FileStore struct {
+	Path string
+}
+
+// List returns every lock of the file, none when it doesn't exist
+func (s *FileStore) List() ([]*Lock, error) {
+	content, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	locks, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("wasn't able to read lock file %s: %s", s.Path, err)
+	}
+	return locks, nil
+}
+
+// Update changes the locks of the file, waiting for other updates to end
+func (s *FileStore) Update(message string, change func(locks []*Lock) ([]*Lock, error)) error {
+	release, err := s.guard()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	locks, err := s.List()
+	if err != nil {
+		return err
+	}
+	locks, err = change(locks)
+	if err != nil {
+		return err
+	}
+	content, err := Encode(locks)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// guard creates the guard file, waiting up to 10 seconds for another process to remove it
+func (s *FileStore) guard() (func(), error) {
+	path := s.Path + ".guard"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleGuard {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock file %s is being updated by another process (remove %s if it's not)", s.Path, path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,223 @@
+// Package lock prevents two operators from deploying the same clients at once. Locks are kept in a Store,
+// a JSON file listing them, which is updated atomically.
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Global is the name of the lock held on every client
+const Global = "all"
+
+// Lock is held by an operator on a client, or on every client for the Global lock, until it expires
+type Lock struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Live tells if the lock hasn't expired at now
+func (l *Lock) Live(now time.Time) bool {
+	return l.Expires.After(now)
+}
+
+// String describes a lock for messages
+func (l *Lock) String() string {
+	name := "client " + l.Name
+	if l.Name == Global {
+		name = "every client (global lock)"
+	}
+	description := fmt.Sprintf("%s is locked by %s until %s", name, l.Owner, l.Expires.Local().Format("2006-01-02 15:04:05"))
+	if l.Reason != "" {
+		description += ": " + l.Reason
+	}
+	return description
+}
+
+// Store keeps the locks
+type Store interface {
+	// List returns every lock, including expired ones
+	List() ([]*Lock, error)
+	// Update changes the locks atomically, change being called with the current ones. Message describes the change
+	Update(message string, change func(locks []*Lock) ([]*Lock, error)) error
+}
+
+// ConflictError is returned when live locks of other operators prevent acquiring locks
+type ConflictError struct {
+	Locks []*Lock
+}
+
+func (e *ConflictError) Error() string {
+	descriptions := make([]string, len(e.Locks))
+	for i, l := range e.Locks {
+		descriptions[i] = l.String()
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Acquire locks names for owner until now + ttl. It fails with a ConflictError when other operators hold live locks
+// on names or the Global lock, unless force is set: their locks on names are then taken over. Locks already held by owner
+// are kept as they are. It returns the names which have been locked, expired locks being dropped.
+func Acquire(store Store, names []string, owner string, reason string, ttl time.Duration, force bool) ([]string, error) {
+	var acquired []string
+	err := store.Update("Lock "+describe(names), func(locks []*Lock) ([]*Lock, error) {
+		now := time.Now().UTC()
+		acquired = nil
+		held := make(map[string]*Lock)
+		var conflicts []*Lock
+		for _, l := range locks {
+			if !l.Live(now) {
+				continue
+			}
+			held[l.Name] = l
+			if l.Owner != owner && (l.Name == Global || contains(names, l.Name)) {
+				conflicts = append(conflicts, l)
+			}
+		}
+		if len(conflicts) > 0 && !force {
+			return nil, &ConflictError{Locks: conflicts}
+		}
+
+		for _, name := range names {
+			if l := held[name]; l != nil && l.Owner == owner {
+				continue
+			}
+			held[name] = &Lock{Name: name, Owner: owner, Reason: reason, Created: now, Expires: now.Add(ttl)}
+			acquired = append(acquired, name)
+		}
+		return sorted(held), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acquired, nil
+}
+
+// Refresh extends until now + ttl the locks of names held by owner, locking again the names whose lock expired.
+// Locks which other operators took over meanwhile are left to them, they are returned in a ConflictError once the
+// others have been refreshed
+func Refresh(store Store, names []string, owner string, reason string, ttl time.Duration) error {
+	var conflicts []*Lock
+	err := store.Update("Refresh lock "+describe(names), func(locks []*Lock) ([]*Lock, error) {
+		now := time.Now().UTC()
+		conflicts = nil
+		held := make(map[string]*Lock)
+		for _, l := range locks {
+			if l.Live(now) {
+				held[l.Name] = l
+			}
+		}
+		for _, name := range names {
+			switch l := held[name]; {
+			case l == nil:
+				held[name] = &Lock{Name: name, Owner: owner, Reason: reason, Created: now, Expires: now.Add(ttl)}
+			case l.Owner == owner:
+				l.Expires = now.Add(ttl)
+			default:
+				conflicts = append(conflicts, l)
+			}
+		}
+		return sorted(held), nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Locks: conflicts}
+	}
+	return nil
+}
+
+// Release unlocks names held by owner, or by anyone with force. Names which aren't locked are ignored.
+// It returns the locks which have been released
+func Release(store Store, names []string, owner string, force bool) ([]*Lock, error) {
+	var released []*Lock
+	err := store.Update("Unlock "+describe(names), func(locks []*Lock) ([]*Lock, error) {
+		now := time.Now().UTC()
+		released = nil
+		var kept []*Lock
+		var others []*Lock
+		for _, l := range locks {
+			switch {
+			case !contains(names, l.Name):
+				if l.Live(now) {
+					kept = append(kept, l)
+				}
+			case l.Owner == owner || force || !l.Live(now):
+				released = append(released, l)
+			default:
+				others = append(others, l)
+			}
+		}
+		if len(others) > 0 {
+			return nil, fmt.Errorf("%s, use --force to unlock anyway", (&ConflictError{Locks: others}).Error())
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// Parse reads the locks of a lock file, an empty file has no lock
+func Parse(content []byte) ([]*Lock, error) {
+	var locks []*Lock
+	if len(strings.TrimSpace(string(content))) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(content, &locks); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// Encode returns the content of a lock file
+func Encode(locks []*Lock) ([]byte, error) {
+	if locks == nil {
+		locks = []*Lock{}
+	}
+	content, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+// describe returns the locked names for messages, only their count when there are many
+func describe(names []string) string {
+	if len(names) > 5 {
+		return fmt.Sprintf("%d clients", len(names))
+	}
+	return strings.Join(names, ", ")
+}
+
+// sorted returns the locks by name, the global lock first
+func sorted(held map[string]*Lock) []*Lock {
+	locks := make([]*Lock, 0, len(held))
+	for _, l := range held {
+		locks = append(locks, l)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		if (locks[i].Name == Global) != (locks[j].Name == Global) {
+			return locks[i].Name == Global
+		}
+		return locks[i].Name < locks[j].Name
+	})
+	return locks
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
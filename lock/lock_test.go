@@ -0,0 +1,65 @@
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+// held returns the live locks of store by name
+func held(t *testing.T, store Store) map[string]*Lock {
+	t.Helper()
+	locks, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	live := make(map[string]*Lock)
+	for _, l := range locks {
+		if l.Live(now) {
+			live[l.Name] = l
+		}
+	}
+	return live
+}
+
+func TestRefresh(t *testing.T) {
+	store := &FileStore{Path: t.TempDir() + "/locks.json"}
+	if _, err := Acquire(store, []string{"acme", "globex"}, "alice", "deploy", time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Acquire(store, []string{"globex"}, "bob", "hotfix", time.Minute, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Refresh(store, []string{"acme", "globex", "initech"}, "alice", "deploy", time.Hour)
+
+	conflict, ok := err.(*ConflictError)
+	if !ok || len(conflict.Locks) != 1 || conflict.Locks[0].Owner != "bob" {
+		t.Fatalf("expected a conflict with the lock bob took over, got %v", err)
+	}
+	locks := held(t, store)
+	if l := locks["acme"]; l == nil || l.Owner != "alice" || time.Until(l.Expires) < 50*time.Minute {
+		t.Errorf("expected the lock of alice on acme to be extended, got %v", l)
+	}
+	if l := locks["globex"]; l == nil || l.Owner != "bob" || time.Until(l.Expires) > time.Minute {
+		t.Errorf("expected the lock of bob on globex to be left as it is, got %v", l)
+	}
+	if l := locks["initech"]; l == nil || l.Owner != "alice" {
+		t.Errorf("expected the missing lock on initech to be recreated for alice, got %v", l)
+	}
+}
+
+func TestAcquireConflict(t *testing.T) {
+	store := &FileStore{Path: t.TempDir() + "/locks.json"}
+	if _, err := Acquire(store, []string{Global}, "bob", "release freeze", time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Acquire(store, []string{"acme"}, "alice", "deploy", time.Minute, false); err == nil {
+		t.Fatal("expected the global lock of bob to prevent alice from locking acme")
+	}
+	acquired, err := Acquire(store, []string{"acme"}, "alice", "deploy", time.Minute, true)
+	if err != nil || len(acquired) != 1 {
+		t.Fatalf("expected alice to lock acme with force, got %v (%v)", acquired, err)
+	}
+}
@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError reports an invalid line of a clients file
+type ValidationError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// Errors gathers every validation error found in a clients file
+type Errors []*ValidationError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
@@ -0,0 +1,302 @@
+// Package registry reads and validates the clients file, which declares every client
+// and the applications deployed for them.
+//
+// The file is a CSV file whose first line is a header declaring the columns:
+//
+//	client_id,apps,tags,region
+//	# comments and blank lines are ignored
+//	acme,api;web,beta,eu
+//	# deleted initech 2018-09-01T10:00:00Z: initech,api,,us
+//
+// client_id and apps columns are mandatory, apps and tags are lists separated by ';'.
+// Any other column is kept as a client attribute.
+//
+// Deleted clients are kept as "# deleted" comments (tombstones) so their id can't be reused by mistake.
+//
+// Clients files ending with .yaml, .yml or .json are structured files (see document), which can also hold
+// client pipeline variables and metadata.
+package registry
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	ColumnId   = "client_id"
+	ColumnApps = "apps"
+	ColumnTags = "tags"
+
+	// ListSeparator separates values of list columns (apps, tags)
+	ListSeparator = ";"
+
+	// All is the reserved keyword used to select every client
+	All = "all"
+)
+
+var (
+	idPattern        = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	tombstonePattern = regexp.MustCompile(`^#\s*deleted\s+(\S+)\s+(\S+):`)
+)
+
+// Client is a client declared in the registry
+type Client struct {
+	Id         string
+	Apps       []string
+	Tags       []string
+	Attributes map[string]string
+	// Variables and AppVariables (by app name) are pipeline variables, only structured files hold them
+	Variables    map[string]string
+	AppVariables map[string]map[string]string
+	// Line is the line of the client in CSV files, its position in structured files
+	Line int
+	// Comments are the comments of the client in structured files, CSV comment lines preceding it are kept there on convert
+	Comments []string
+}
+
+// HasApp tells if the application is deployed for the client
+func (c *Client) HasApp(app string) bool {
+	return contains(c.Apps, app)
+}
+
+// HasTag tells if the client has been tagged with tag
+func (c *Client) HasTag(tag string) bool {
+	return contains(c.Tags, tag)
+}
+
+// Registry holds every client declared in a clients file
+type Registry struct {
+	Path    string
+	Format  Format
+	Columns []string
+	Clients []*Client
+	// Tombstones are the clients which have been deleted
+	Tombstones []*Tombstone
+	// Variables and AppVariables (by app name) are pipeline variables of every client, only structured files hold them
+	Variables    map[string]string
+	AppVariables map[string]map[string]string
+	// Revision is the version of the source the registry has been read from (e.g. a commit sha), if known
+	Revision string
+	// Comments are the comments of the file in structured files, like Client.Comments
+	Comments []string
+
+	// lines keeps comments, blank lines and clients in file order, so the file can be rewritten as is
+	lines []*line
+	// columnsChanged is set when columns have been added since the file has been read
+	columnsChanged bool
+}
+
+// Tombstone is a deleted client, its line is kept as a comment
+type Tombstone struct {
+	Id   string
+	Date string
+	Line int
+	// Client is the content of the client when it was deleted, if known
+	Client *Client
+}
+
+// line is a line of the clients file, kept raw unless its client has been modified (or the columns changed)
+type line struct {
+	raw      string
+	client   *Client
+	header   bool
+	modified bool
+}
+
+// Get returns the client with this exact id, nil if it doesn't exist
+func (r *Registry) Get(id string) *Client {
+	for _, c := range r.Clients {
+		if c.Id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Tombstone returns the tombstone of a deleted client, nil if the client has never been deleted
+func (r *Registry) Tombstone(id string) *Tombstone {
+	for _, t := range r.Tombstones {
+		if t.Id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// ValidId tells if id can be used as a client id
+func ValidId(id string) bool {
+	return idPattern.MatchString(id) && id != All
+}
+
+// Load reads and validates the clients file at path, its format is given by its extension
+func Load(path string) (*Registry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file, path)
+}
+
+// Read reads and validates a clients file whose format is given by the extension of name
+func Read(in io.Reader, name string) (*Registry, error) {
+	return ReadFormat(in, name, FormatOf(name))
+}
+
+// ReadFormat reads and validates a clients file of the given format, name is only used in error messages
+func ReadFormat(in io.Reader, name string, format Format) (*Registry, error) {
+	if format != FormatCSV {
+		return parseStructured(in, name, format)
+	}
+	return Parse(in, name)
+}
+
+// Parse reads and validates a CSV clients file, name is only used in error messages
+func Parse(in io.Reader, name string) (*Registry, error) {
+	reg := &Registry{Path: name, Format: FormatCSV}
+	var errs Errors
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{File: name, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	declared := make(map[string]int)
+
+	scanner := bufio.NewScanner(in)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		text := strings.TrimSpace(raw)
+		if text == "" || strings.HasPrefix(text, "#") {
+			if match := tombstonePattern.FindStringSubmatch(text); match != nil {
+				tombstone := &Tombstone{Id: match[1], Date: match[2], Line: lineNumber}
+				// Keep the deleted client content when it can still be read. Columns added since the client was
+				// deleted are missing from its content, they are left empty
+				record, err := csv.NewReader(strings.NewReader(strings.TrimSpace(text[len(match[0]):]))).Read()
+				if err == nil && reg.Columns != nil && len(record) <= len(reg.Columns) {
+					for len(record) < len(reg.Columns) {
+						record = append(record, "")
+					}
+					tombstone.Client = newClient(reg.Columns, record, lineNumber)
+				}
+				reg.Tombstones = append(reg.Tombstones, tombstone)
+			}
+			reg.lines = append(reg.lines, &line{raw: raw})
+			continue
+		}
+
+		record, err := csv.NewReader(strings.NewReader(text)).Read()
+		if err != nil {
+			fail(lineNumber, "invalid CSV: %s", err)
+			continue
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		// The first line declares the columns
+		if reg.Columns == nil {
+			if err := checkHeader(record); err != nil {
+				fail(lineNumber, "%s", err)
+				return nil, errs
+			}
+			reg.Columns = record
+			reg.lines = append(reg.lines, &line{raw: raw, header: true})
+			continue
+		}
+
+		if len(record) != len(reg.Columns) {
+			fail(lineNumber, "expected %d columns (%s), got %d", len(reg.Columns), strings.Join(reg.Columns, ","), len(record))
+			continue
+		}
+		client := newClient(reg.Columns, record, lineNumber)
+		if !ValidId(client.Id) {
+			fail(lineNumber, "invalid client id %q", client.Id)
+			continue
+		}
+		if first, ok := declared[client.Id]; ok {
+			fail(lineNumber, "duplicate client id %q (first declared line %d)", client.Id, first)
+			continue
+		}
+		declared[client.Id] = lineNumber
+		reg.Clients = append(reg.Clients, client)
+		reg.lines = append(reg.lines, &line{raw: raw, client: client})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if reg.Columns == nil {
+		fail(lineNumber, "missing header line")
+	}
+	for _, client := range reg.Clients {
+		if t := reg.Tombstone(client.Id); t != nil {
+			fail(client.Line, "client id %q has been deleted on %s (line %d), remove its tombstone to reuse it", client.Id, t.Date, t.Line)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return reg, nil
+}
+
+// checkHeader ensures mandatory columns are declared once
+func checkHeader(columns []string) error {
+	seen := make(map[string]bool)
+	for _, column := range columns {
+		if column == "" {
+			return fmt.Errorf("empty column name in header")
+		}
+		if seen[column] {
+			return fmt.Errorf("column %q is declared twice in header", column)
+		}
+		seen[column] = true
+	}
+	for _, column := range []string{ColumnId, ColumnApps} {
+		if !seen[column] {
+			return fmt.Errorf("missing mandatory column %q in header", column)
+		}
+	}
+	return nil
+}
+
+func newClient(columns []string, record []string, line int) *Client {
+	client := &Client{Line: line, Attributes: make(map[string]string)}
+	for i, column := range columns {
+		switch column {
+		case ColumnId:
+			client.Id = record[i]
+		case ColumnApps:
+			client.Apps = splitList(record[i])
+		case ColumnTags:
+			client.Tags = splitList(record[i])
+		default:
+			client.Attributes[column] = record[i]
+		}
+	}
+	return client
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ListSeparator) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
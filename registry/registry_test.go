@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	content := `# clients of the platform
+client_id,apps,tags,region
+
+acme, api;web ,beta;eu,eu
+  # deleted initech 2018-09-01T10:00:00Z: initech,api,,us
+globex,api,,us
+`
+	reg, err := Parse(strings.NewReader(content), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(reg.Columns, ",") != "client_id,apps,tags,region" {
+		t.Errorf("unexpected columns %v", reg.Columns)
+	}
+	if len(reg.Clients) != 2 {
+		t.Fatalf("expected 2 clients, got %d", len(reg.Clients))
+	}
+	acme := reg.Get("acme")
+	if acme == nil || acme.Line != 4 || strings.Join(acme.Apps, ",") != "api,web" || !acme.HasTag("eu") || acme.Attributes["region"] != "eu" {
+		t.Errorf("unexpected client acme %+v", acme)
+	}
+	if globex := reg.Get("globex"); globex == nil || globex.Line != 6 || len(globex.Tags) != 0 {
+		t.Errorf("unexpected client globex %+v", globex)
+	}
+	tombstone := reg.Tombstone("initech")
+	if tombstone == nil || tombstone.Line != 5 || tombstone.Date != "2018-09-01T10:00:00Z" {
+		t.Fatalf("unexpected tombstone of initech %+v", tombstone)
+	}
+	if tombstone.Client == nil || !tombstone.Client.HasApp("api") || tombstone.Client.Attributes["region"] != "us" {
+		t.Errorf("expected the content of initech to be kept, got %+v", tombstone.Client)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	type expectedError struct {
+		line    int
+		message string
+	}
+	for _, test := range []struct {
+		name    string
+		content string
+		errors  []expectedError
+	}{
+		{"empty file", "", []expectedError{{0, "missing header line"}}},
+		{"comments only", "# no client yet\n\n", []expectedError{{2, "missing header line"}}},
+		{"empty column", "client_id,,apps\n", []expectedError{{1, "empty column name in header"}}},
+		{"duplicate column", "client_id,apps,apps\n", []expectedError{{1, `column "apps" is declared twice in header`}}},
+		{"missing client_id", "# header\napps,tags\nacme,api\n", []expectedError{{2, `missing mandatory column "client_id" in header`}}},
+		{"missing apps", "client_id,tags\n", []expectedError{{1, `missing mandatory column "apps" in header`}}},
+		{"column count", "client_id,apps\nacme,api\nglobex\n", []expectedError{{3, "expected 2 columns (client_id,apps), got 1"}}},
+		{"invalid csv", "client_id,apps\nacme,\"api\n", []expectedError{{2, "invalid CSV"}}},
+		{"invalid id", "client_id,apps\n-acme,api\n", []expectedError{{2, `invalid client id "-acme"`}}},
+		{"reserved id", "client_id,apps\nall,api\n", []expectedError{{2, `invalid client id "all"`}}},
+		{"empty id", "client_id,apps\n,api\n", []expectedError{{2, `invalid client id ""`}}},
+		{"duplicate id", "client_id,apps\nacme,api\n\nacme,web\n", []expectedError{{4, `duplicate client id "acme" (first declared line 2)`}}},
+		{"deleted id", "client_id,apps\n# deleted acme 2018-09-01T10:00:00Z: acme,api\nacme,api\n",
+			[]expectedError{{3, `client id "acme" has been deleted on 2018-09-01T10:00:00Z (line 2), remove its tombstone to reuse it`}}},
+		{"every error", "client_id,apps\nacme,api,eu\nacme\nglobex:1,api\n", []expectedError{
+			{2, "expected 2 columns"},
+			{3, "expected 2 columns"},
+			{4, `invalid client id "globex:1"`},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.content), "clients.csv")
+
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("expected validation errors, got %v", err)
+			}
+			if len(errs) != len(test.errors) {
+				t.Fatalf("expected %d error(s), got %d:\n%s", len(test.errors), len(errs), errs)
+			}
+			for i, expected := range test.errors {
+				if errs[i].File != "clients.csv" || errs[i].Line != expected.line || !strings.Contains(errs[i].Message, expected.message) {
+					t.Errorf("expected error %q at line %d, got %q", expected.message, expected.line, errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidationErrorLocation(t *testing.T) {
+	err := &ValidationError{File: "clients.csv", Line: 3, Message: "invalid client id"}
+	if err.Error() != "clients.csv:3: invalid client id" {
+		t.Errorf("unexpected message %q", err)
+	}
+	err.Line = 0
+	if err.Error() != "clients.csv: invalid client id" {
+		t.Errorf("unexpected message without line %q", err)
+	}
+}
+
+func TestParseTombstoneBeforeNewColumns(t *testing.T) {
+	content := `client_id,apps,tags,region
+# deleted initech 2018-09-01T10:00:00Z: initech,api
+# deleted umbrella 2018-09-01T10:00:00Z: umbrella,api,,us,extra
+acme,api,,eu
+`
+	reg, err := Parse(strings.NewReader(content), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initech := reg.Tombstone("initech")
+	if initech == nil || initech.Client == nil || !initech.Client.HasApp("api") || initech.Client.Attributes["region"] != "" {
+		t.Errorf("expected the missing columns of initech to be empty, got %+v", initech)
+	}
+	if umbrella := reg.Tombstone("umbrella"); umbrella == nil || umbrella.Client != nil {
+		t.Errorf("expected the content of umbrella with too many columns to be ignored, got %+v", umbrella)
+	}
+	assertContent(t, reg, content)
+}
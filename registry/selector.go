@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selector picks clients by id patterns, column conditions and exclusions.
+//
+// Ids and exclusions are exact ids or glob patterns (acme-*), All matching every client.
+// Conditions are column=value pairs, value being a glob pattern too. tag and app match any
+// value of the tags and apps lists.
+type Selector struct {
+	Ids        []string
+	Conditions []Condition
+	Exclude    []string
+}
+
+// Condition requires the column of a client to match a value
+type Condition struct {
+	Column string
+	Value  string
+}
+
+// ParseConditions reads column=value pairs separated by commas (tag=beta,region=eu)
+func ParseConditions(expr string) ([]Condition, error) {
+	var conditions []Condition
+	for _, pair := range strings.Split(expr, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		column := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || column == "" {
+			return nil, fmt.Errorf("invalid condition %q, expected column=value", pair)
+		}
+		if _, err := path.Match(parts[1], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in condition %q: %s", pair, err)
+		}
+		conditions = append(conditions, Condition{Column: column, Value: strings.TrimSpace(parts[1])})
+	}
+	return conditions, nil
+}
+
+// Select returns clients matching the selector, in file order. Exact ids which aren't declared,
+// unknown columns and invalid patterns are errors
+func (r *Registry) Select(s *Selector) ([]*Client, error) {
+	for _, id := range append(append([]string{}, s.Ids...), s.Exclude...) {
+		if _, err := path.Match(id, ""); err != nil {
+			return nil, fmt.Errorf("invalid client pattern %q: %s", id, err)
+		}
+		if id != All && !isPattern(id) && r.Get(id) == nil {
+			return nil, fmt.Errorf("client %s has not been found in %s", id, r.Path)
+		}
+	}
+	for _, c := range s.Conditions {
+		if !r.HasColumn(conditionColumn(c.Column)) {
+			return nil, fmt.Errorf("unknown column %q in %s (columns: %s)", c.Column, r.Path, strings.Join(r.Columns, ","))
+		}
+	}
+
+	var clients []*Client
+	for _, client := range r.Clients {
+		if matchId(client.Id, s.Ids) && !matchId(client.Id, s.Exclude) && client.matchConditions(s.Conditions) {
+			clients = append(clients, client)
+		}
+	}
+	return clients, nil
+}
+
+// Match tells if the client matches the condition
+func (c Condition) Match(client *Client) bool {
+	var values []string
+	switch conditionColumn(c.Column) {
+	case ColumnId:
+		values = []string{client.Id}
+	case ColumnApps:
+		values = client.Apps
+	case ColumnTags:
+		values = client.Tags
+	default:
+		values = []string{client.Attributes[c.Column]}
+	}
+	for _, value := range values {
+		if ok, _ := path.Match(c.Value, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) matchConditions(conditions []Condition) bool {
+	for _, condition := range conditions {
+		if !condition.Match(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// conditionColumn maps condition shortcuts (id, app, tag) to their column
+func conditionColumn(column string) string {
+	switch column {
+	case "id":
+		return ColumnId
+	case "app":
+		return ColumnApps
+	case "tag":
+		return ColumnTags
+	}
+	return column
+}
+
+// matchId tells if id matches one of the patterns
+func matchId(id string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == All {
+			return true
+		}
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isPattern(id string) bool {
+	return strings.ContainsAny(id, `*?[\`)
+}
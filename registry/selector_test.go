@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+const selectorClients = `client_id,apps,tags,region
+acme-eu,api;web,beta,eu
+acme-us,api,beta;vip,us
+globex,web,,eu
+initech,api,vip,us
+`
+
+func TestParseConditions(t *testing.T) {
+	conditions, err := ParseConditions(" tag=beta, region = e* ,,app=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Condition{{"tag", "beta"}, {"region", "e*"}, {"app", "api"}}
+	if len(conditions) != len(expected) {
+		t.Fatalf("expected conditions %v, got %v", expected, conditions)
+	}
+	for i, c := range expected {
+		if conditions[i] != c {
+			t.Errorf("expected condition %v, got %v", c, conditions[i])
+		}
+	}
+
+	for _, expr := range []string{"beta", "=beta", "tag=[beta"} {
+		if _, err := ParseConditions(expr); err == nil {
+			t.Errorf("expected condition %q to be invalid", expr)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	reg, err := Parse(strings.NewReader(selectorClients), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		selector Selector
+		expected string
+	}{
+		{"all", Selector{Ids: []string{All}}, "acme-eu,acme-us,globex,initech"},
+		{"ids", Selector{Ids: []string{"initech", "acme-eu"}}, "acme-eu,initech"},
+		{"glob", Selector{Ids: []string{"acme-*"}}, "acme-eu,acme-us"},
+		{"single character", Selector{Ids: []string{"acme-?s"}}, "acme-us"},
+		{"no match", Selector{Ids: []string{"umbrella-*"}}, ""},
+		{"tag", Selector{Ids: []string{All}, Conditions: []Condition{{"tag", "vip"}}}, "acme-us,initech"},
+		{"tags column", Selector{Ids: []string{All}, Conditions: []Condition{{"tags", "beta"}}}, "acme-eu,acme-us"},
+		{"app", Selector{Ids: []string{All}, Conditions: []Condition{{"app", "web"}}}, "acme-eu,globex"},
+		{"attribute pattern", Selector{Ids: []string{All}, Conditions: []Condition{{"region", "e?"}}}, "acme-eu,globex"},
+		{"id condition", Selector{Ids: []string{All}, Conditions: []Condition{{"id", "*-us"}}}, "acme-us"},
+		{"every condition", Selector{Ids: []string{All}, Conditions: []Condition{{"tag", "beta"}, {"region", "us"}}}, "acme-us"},
+		{"exclude", Selector{Ids: []string{All}, Exclude: []string{"globex"}}, "acme-eu,acme-us,initech"},
+		{"exclude pattern", Selector{Ids: []string{All}, Conditions: []Condition{{"app", "api"}}, Exclude: []string{"acme-*"}}, "initech"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			selector := test.selector
+			clients, err := reg.Select(&selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, client := range clients {
+				ids = append(ids, client.Id)
+			}
+			if strings.Join(ids, ",") != test.expected {
+				t.Errorf("expected clients %q, got %q", test.expected, strings.Join(ids, ","))
+			}
+		})
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	reg, err := Parse(strings.NewReader(selectorClients), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		selector Selector
+		message  string
+	}{
+		{Selector{Ids: []string{"umbrella"}}, "client umbrella has not been found"},
+		{Selector{Ids: []string{All}, Exclude: []string{"umbrella"}}, "client umbrella has not been found"},
+		{Selector{Ids: []string{"acme-[eu"}}, "invalid client pattern"},
+		{Selector{Ids: []string{All}, Conditions: []Condition{{"contact", "ops"}}}, `unknown column "contact"`},
+	} {
+		selector := test.selector
+		if _, err := reg.Select(&selector); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("expected error %q for %+v, got %v", test.message, test.selector, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Format is the file format of a clients file
+type Format string
+
+const (
+	FormatCSV  Format = "csv"
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// FormatOf returns the format of a clients file from its extension, CSV by default
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	}
+	return FormatCSV
+}
+
+// document is the content of a YAML or JSON clients file:
+//
+//	comments: [clients of the platform]
+//	variables: {ENV: prod}
+//	app_variables: {api: {REPLICAS: "3"}}
+//	clients:
+//	  - id: acme
+//	    comments: [beta clients]
+//	    apps: [api, web]
+//	    tags: [beta]
+//	    variables: {ENV: prod}
+//	    app_variables: {api: {VERSION: v1.2}}
+//	    metadata: {region: eu, contact: ops@acme.com}
+//	deleted:
+//	  - id: initech
+//	    date: 2018-09-01T10:00:00Z
+type document struct {
+	Comments     []string                     `yaml:"comments,omitempty" json:"comments,omitempty"`
+	Variables    map[string]string            `yaml:"variables,omitempty" json:"variables,omitempty"`
+	AppVariables map[string]map[string]string `yaml:"app_variables,omitempty" json:"app_variables,omitempty"`
+	Clients      []*clientDocument            `yaml:"clients" json:"clients"`
+	Deleted      []*tombstoneDocument         `yaml:"deleted,omitempty" json:"deleted,omitempty"`
+}
+
+type clientDocument struct {
+	Id           string                       `yaml:"id" json:"id"`
+	Comments     []string                     `yaml:"comments,omitempty" json:"comments,omitempty"`
+	Apps         []string                     `yaml:"apps" json:"apps"`
+	Tags         []string                     `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Variables    map[string]string            `yaml:"variables,omitempty" json:"variables,omitempty"`
+	AppVariables map[string]map[string]string `yaml:"app_variables,omitempty" json:"app_variables,omitempty"`
+	Metadata     map[string]string            `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+type tombstoneDocument struct {
+	Id     string          `yaml:"id" json:"id"`
+	Date   string          `yaml:"date" json:"date"`
+	Client *clientDocument `yaml:"client,omitempty" json:"client,omitempty"`
+}
+
+// parseStructured reads and validates a YAML or JSON clients file, name is only used in error messages.
+// As there are no meaningful line numbers, clients are located by their position in the file
+func parseStructured(in io.Reader, name string, format Format) (*Registry, error) {
+	content, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	if format == FormatJSON {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&doc)
+	} else {
+		err = yaml.UnmarshalStrict(content, &doc)
+	}
+	if err != nil {
+		return nil, Errors{{File: name, Message: err.Error()}}
+	}
+
+	reg := &Registry{Path: name, Format: format, Variables: doc.Variables, AppVariables: doc.AppVariables, Comments: doc.Comments}
+	var errs Errors
+	for _, message := range reservedVariables(doc.Variables, doc.AppVariables) {
+		errs = append(errs, &ValidationError{File: name, Message: message})
+	}
+	fail := func(position int, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{File: name, Message: fmt.Sprintf("client %d: ", position) + fmt.Sprintf(format, args...)})
+	}
+	failDeleted := func(position int, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{File: name, Message: fmt.Sprintf("deleted client %d: ", position) + fmt.Sprintf(format, args...)})
+	}
+	for i, t := range doc.Deleted {
+		position := i + 1
+		if t == nil {
+			failDeleted(position, "empty deleted client")
+			continue
+		}
+		if !ValidId(t.Id) {
+			failDeleted(position, "invalid client id %q", t.Id)
+			continue
+		}
+		reg.Tombstones = append(reg.Tombstones, &Tombstone{Id: t.Id, Date: t.Date, Line: position, Client: t.Client.client(0)})
+	}
+	declared := make(map[string]int)
+	for i, c := range doc.Clients {
+		position := i + 1
+		if c == nil {
+			fail(position, "empty client")
+			continue
+		}
+		client := c.client(position)
+		if !ValidId(client.Id) {
+			fail(position, "invalid client id %q", client.Id)
+			continue
+		}
+		if first, ok := declared[client.Id]; ok {
+			fail(position, "duplicate client id %q (first declared client %d)", client.Id, first)
+			continue
+		}
+		if t := reg.Tombstone(client.Id); t != nil {
+			fail(position, "client id %q has been deleted on %s, remove it from deleted clients to reuse it", client.Id, t.Date)
+			continue
+		}
+		for _, message := range reservedVariables(client.Variables, client.AppVariables) {
+			fail(position, "%s", message)
+		}
+		declared[client.Id] = position
+		reg.Clients = append(reg.Clients, client)
+	}
+	reg.Columns = structuredColumns(reg.Clients)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return reg, nil
+}
+
+// ReservedVariables are pipeline variables set by the deployer, they can't be set in a clients file
+var ReservedVariables = []string{"client_id", "app_name"}
+
+// reservedVariables returns a message for every reserved variable set in variables or in variables of an app
+func reservedVariables(variables map[string]string, appVariables map[string]map[string]string) []string {
+	var messages []string
+	check := func(variables map[string]string, source string) {
+		for _, reserved := range ReservedVariables {
+			if _, ok := variables[reserved]; ok {
+				messages = append(messages, fmt.Sprintf("variable %s of %s is set by the deployer and can't be overridden", reserved, source))
+			}
+		}
+	}
+	check(variables, "variables")
+	apps := make([]string, 0, len(appVariables))
+	for app := range appVariables {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		check(appVariables[app], "app_variables."+app)
+	}
+	return messages
+}
+
+// structuredColumns returns the columns of structured clients: mandatory ones, then metadata keys sorted
+func structuredColumns(clients []*Client) []string {
+	seen := make(map[string]bool)
+	var metadata []string
+	for _, client := range clients {
+		for key := range client.Attributes {
+			if !seen[key] {
+				seen[key] = true
+				metadata = append(metadata, key)
+			}
+		}
+	}
+	sort.Strings(metadata)
+	return append([]string{ColumnId, ColumnApps, ColumnTags}, metadata...)
+}
+
+// writeStructured writes the registry as a YAML or JSON clients file
+func (r *Registry) writeStructured(out io.Writer) error {
+	doc := document{Comments: r.Comments, Variables: r.Variables, AppVariables: r.AppVariables, Clients: []*clientDocument{}}
+	for _, client := range r.Clients {
+		doc.Clients = append(doc.Clients, newClientDocument(client))
+	}
+	for _, t := range r.Tombstones {
+		doc.Deleted = append(doc.Deleted, &tombstoneDocument{Id: t.Id, Date: t.Date, Client: newClientDocument(t.Client)})
+	}
+
+	if r.Format == FormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	}
+	content, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(content)
+	return err
+}
+
+func (c *clientDocument) client(position int) *Client {
+	if c == nil {
+		return nil
+	}
+	client := &Client{
+		Id:           c.Id,
+		Comments:     c.Comments,
+		Apps:         c.Apps,
+		Tags:         c.Tags,
+		Variables:    c.Variables,
+		AppVariables: c.AppVariables,
+		Attributes:   c.Metadata,
+		Line:         position,
+	}
+	if client.Attributes == nil {
+		client.Attributes = make(map[string]string)
+	}
+	return client
+}
+
+func newClientDocument(client *Client) *clientDocument {
+	if client == nil {
+		return nil
+	}
+	c := &clientDocument{
+		Id:           client.Id,
+		Comments:     client.Comments,
+		Apps:         client.Apps,
+		Tags:         client.Tags,
+		Variables:    client.Variables,
+		AppVariables: client.AppVariables,
+		Metadata:     client.Attributes,
+	}
+	if c.Apps == nil {
+		c.Apps = []string{}
+	}
+	if len(c.Metadata) == 0 {
+		c.Metadata = nil
+	}
+	return c
+}
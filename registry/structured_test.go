@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadFormatIgnoresName(t *testing.T) {
+	content := `clients:
+  - id: acme
+    apps: [api]
+`
+	reg, err := ReadFormat(strings.NewReader(content), "clients.yaml@master", FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Format != FormatYAML || len(reg.Clients) != 1 || reg.Clients[0].Id != "acme" {
+		t.Fatalf("expected the YAML client acme, got format %s and %d clients", reg.Format, len(reg.Clients))
+	}
+
+	written, err := reg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(written), "- id: acme") {
+		t.Errorf("expected the clients file to be written as YAML, got:\n%s", written)
+	}
+}
+
+func TestReadFormatInvalidTombstones(t *testing.T) {
+	content := `clients:
+  - id: acme
+    apps: [api]
+deleted:
+  -
+  - id: "not a client"
+    date: 2018-09-01T10:00:00Z
+  - id: initech
+    date: 2018-09-01T10:00:00Z
+`
+	_, err := ReadFormat(strings.NewReader(content), "clients.yaml", FormatYAML)
+
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 validation errors, got %v", err)
+	}
+	for i, expected := range []string{"deleted client 1: empty deleted client", `deleted client 2: invalid client id "not a client"`} {
+		if !strings.Contains(errs[i].Error(), expected) {
+			t.Errorf("expected error %q, got %q", expected, errs[i])
+		}
+	}
+}
+
+func TestReadFormatReservedVariables(t *testing.T) {
+	content := `variables:
+  client_id: acme
+app_variables:
+  web:
+    app_name: api
+clients:
+  - id: acme
+    apps: [api]
+    variables:
+      ENV: production
+  - id: globex
+    apps: [api]
+    app_variables:
+      api:
+        app_name: web
+`
+	_, err := ReadFormat(strings.NewReader(content), "clients.yaml", FormatYAML)
+
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 validation errors, got %v", err)
+	}
+	for i, expected := range []string{
+		"variable client_id of variables is set by the deployer",
+		"variable app_name of app_variables.web is set by the deployer",
+		"client 2: variable app_name of app_variables.api is set by the deployer",
+	} {
+		if !strings.Contains(errs[i].Error(), expected) {
+			t.Errorf("expected error %q, got %q", expected, errs[i])
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Add appends a new client at the end of the registry
+func (r *Registry) Add(client *Client) error {
+	if client.Id == All {
+		return fmt.Errorf("client id %q is reserved", All)
+	}
+	if !ValidId(client.Id) {
+		return fmt.Errorf("invalid client id %q, it must start with a letter or a digit followed by letters, digits, '_', '.' or '-'", client.Id)
+	}
+	if existing := r.Get(client.Id); existing != nil {
+		return fmt.Errorf("client %s already exists in %s line %d", client.Id, r.Path, existing.Line)
+	}
+	if t := r.Tombstone(client.Id); t != nil {
+		return fmt.Errorf("client %s has been deleted on %s (%s line %d), its id can't be reused", client.Id, t.Date, r.Path, t.Line)
+	}
+	if len(client.Tags) > 0 && !r.HasColumn(ColumnTags) {
+		return fmt.Errorf("%s has no %s column", r.Path, ColumnTags)
+	}
+	for name := range client.Attributes {
+		if !r.HasColumn(name) {
+			return fmt.Errorf("%s has no %s column", r.Path, name)
+		}
+	}
+	if client.Attributes == nil {
+		client.Attributes = make(map[string]string)
+	}
+
+	r.Clients = append(r.Clients, client)
+	r.lines = append(r.lines, &line{client: client, modified: true})
+	client.Line = len(r.lines)
+	if r.Format != FormatCSV {
+		client.Line = len(r.Clients)
+	}
+	return nil
+}
+
+// Remove deletes a client, its line is replaced by a tombstone comment keeping its content
+func (r *Registry) Remove(id string, date time.Time) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	encoded, err := r.encode(client)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range r.Clients {
+		if c == client {
+			r.Clients = append(r.Clients[:i], r.Clients[i+1:]...)
+			break
+		}
+	}
+	for i, l := range r.lines {
+		if l.client == client {
+			stamp := date.UTC().Format(time.RFC3339)
+			r.lines[i] = &line{raw: fmt.Sprintf("# deleted %s %s: %s", id, stamp, encoded)}
+			r.Tombstones = append(r.Tombstones, &Tombstone{Id: id, Date: stamp, Line: i + 1, Client: client})
+			break
+		}
+	}
+	if r.Format != FormatCSV {
+		r.Tombstones = append(r.Tombstones, &Tombstone{Id: id, Date: date.UTC().Format(time.RFC3339), Client: client})
+	}
+	return nil
+}
+
+// Set changes an attribute of a client, the column is added to the header if needed
+func (r *Registry) Set(id string, column string, value string) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	switch column {
+	case ColumnId, ColumnApps, ColumnTags:
+		return fmt.Errorf("column %s can't be set as an attribute", column)
+	}
+	if !r.HasColumn(column) {
+		r.Columns = append(r.Columns, column)
+		r.columnsChanged = true
+	}
+	client.Attributes[column] = value
+	r.touch(client)
+	return nil
+}
+
+// AddApp deploys a new application for a client
+func (r *Registry) AddApp(id string, app string) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	if !validItem(app) {
+		return fmt.Errorf("invalid application name %q", app)
+	}
+	if client.HasApp(app) {
+		return fmt.Errorf("application %s is already set for client %s", app, id)
+	}
+	client.Apps = append(client.Apps, app)
+	r.touch(client)
+	return nil
+}
+
+// RemoveApp stops deploying an application for a client
+func (r *Registry) RemoveApp(id string, app string) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	if !client.HasApp(app) {
+		return fmt.Errorf("application %s is not set for client %s", app, id)
+	}
+	client.Apps = remove(client.Apps, app)
+	r.touch(client)
+	return nil
+}
+
+// AddTag tags a client, the tags column is added to the header if needed
+func (r *Registry) AddTag(id string, tag string) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	if !validItem(tag) {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	if client.HasTag(tag) {
+		return nil
+	}
+	if !r.HasColumn(ColumnTags) {
+		r.Columns = append(r.Columns, ColumnTags)
+		r.columnsChanged = true
+	}
+	client.Tags = append(client.Tags, tag)
+	r.touch(client)
+	return nil
+}
+
+// RemoveTag removes a tag from a client, nothing is done if the client doesn't have it
+func (r *Registry) RemoveTag(id string, tag string) error {
+	client := r.Get(id)
+	if client == nil {
+		return fmt.Errorf("client %s not found in %s", id, r.Path)
+	}
+	if client.HasTag(tag) {
+		client.Tags = remove(client.Tags, tag)
+		r.touch(client)
+	}
+	return nil
+}
+
+// touch marks the line of a client as modified, so it's encoded again on write
+func (r *Registry) touch(client *Client) {
+	for _, l := range r.lines {
+		if l.client == client {
+			l.modified = true
+		}
+	}
+}
+
+// validItem tells if value can be used in a list column (apps, tags)
+func validItem(value string) bool {
+	return idPattern.MatchString(value)
+}
+
+func remove(list []string, value string) []string {
+	var kept []string
+	for _, item := range list {
+		if item != value {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// Convert changes the path and format of the registry, the file at path being written by Save. Comment lines of
+// a CSV file become comments of the client they precede in structured files, or comments of the file
+func (r *Registry) Convert(path string) error {
+	format := FormatOf(path)
+	if format == r.Format {
+		r.Path = path
+		return nil
+	}
+
+	if r.Format == FormatCSV {
+		var comments []string
+		for _, l := range r.lines {
+			text := strings.TrimSpace(l.raw)
+			switch {
+			case l.client != nil:
+				l.client.Comments = comments
+				comments = nil
+			case l.header:
+				r.Comments = append(r.Comments, comments...)
+				comments = nil
+			case strings.HasPrefix(text, "#") && !tombstonePattern.MatchString(text):
+				comments = append(comments, strings.TrimSpace(strings.TrimPrefix(text, "#")))
+			}
+		}
+		r.Comments = append(r.Comments, comments...)
+	}
+	if format == FormatCSV {
+		if len(r.Variables) > 0 || len(r.AppVariables) > 0 {
+			return fmt.Errorf("variables of %s can't be stored in a CSV file", r.Path)
+		}
+		var lines []*line
+		for _, comment := range r.Comments {
+			lines = append(lines, &line{raw: commentLine(comment)})
+		}
+		lines = append(lines, &line{header: true})
+		for _, client := range r.Clients {
+			if len(client.Variables) > 0 || len(client.AppVariables) > 0 {
+				return fmt.Errorf("variables of client %s can't be stored in a CSV file", client.Id)
+			}
+			for _, comment := range client.Comments {
+				lines = append(lines, &line{raw: commentLine(comment)})
+			}
+			lines = append(lines, &line{client: client})
+		}
+		for _, t := range r.Tombstones {
+			content := ""
+			if t.Client != nil {
+				encoded, err := r.encode(t.Client)
+				if err != nil {
+					return err
+				}
+				content = " " + encoded
+			}
+			lines = append(lines, &line{raw: fmt.Sprintf("# deleted %s %s:%s", t.Id, t.Date, content)})
+		}
+		r.lines = lines
+		r.columnsChanged = true
+	}
+	r.Path = path
+	r.Format = format
+	return nil
+}
+
+// commentLine returns the CSV line of a comment
+func commentLine(comment string) string {
+	return strings.TrimSpace("# " + comment)
+}
+
+// HasColumn tells if the column is declared in the header
+func (r *Registry) HasColumn(column string) bool {
+	return contains(r.Columns, column)
+}
+
+// Write writes the registry as a clients file. For CSV files, comments, order and unmodified lines of the original
+// file are kept
+func (r *Registry) Write(out io.Writer) error {
+	if r.Format != FormatCSV {
+		return r.writeStructured(out)
+	}
+	for _, l := range r.lines {
+		text := l.raw
+		if l.header && r.columnsChanged {
+			encoded, err := encodeRecord(r.Columns)
+			if err != nil {
+				return err
+			}
+			text = encoded
+		}
+		if l.client != nil && (l.modified || r.columnsChanged) {
+			encoded, err := r.encode(l.client)
+			if err != nil {
+				return err
+			}
+			text = encoded
+		}
+		if _, err := io.WriteString(out, text+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bytes returns the content of the clients file
+func (r *Registry) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Save rewrites the clients file atomically: content is written to a temporary file which then replaces it
+func (r *Registry) Save() error {
+	content, err := r.Bytes()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.Path, content)
+}
+
+// encode returns the CSV line of a client
+func (r *Registry) encode(client *Client) (string, error) {
+	record := make([]string, len(r.Columns))
+	for i, column := range r.Columns {
+		switch column {
+		case ColumnId:
+			record[i] = client.Id
+		case ColumnApps:
+			record[i] = strings.Join(client.Apps, ListSeparator)
+		case ColumnTags:
+			record[i] = strings.Join(client.Tags, ListSeparator)
+		default:
+			record[i] = client.Attributes[column]
+		}
+	}
+	return encodeRecord(record)
+}
+
+// encodeRecord returns a CSV line
+func encodeRecord(record []string) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(record); err != nil {
+		return "", err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// writeFileAtomic writes content to a temporary file in the same directory, then renames it to path
+func writeFileAtomic(path string, content []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
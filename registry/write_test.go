@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clientsFile = `# clients of the platform
+client_id,apps,tags,region
+
+# beta clients
+acme, api;web ,beta,eu
+globex,api,,us
+initech,api,,us
+# end of file
+`
+
+func parseClients(t *testing.T, content string) *Registry {
+	t.Helper()
+	reg, err := Parse(strings.NewReader(content), "clients.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func assertContent(t *testing.T, reg *Registry, expected string) {
+	t.Helper()
+	content, err := reg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("expected clients file:\n%s\ngot:\n%s", expected, content)
+	}
+}
+
+func TestWriteUnchanged(t *testing.T) {
+	assertContent(t, parseClients(t, clientsFile), clientsFile)
+}
+
+func TestWriteKeepsOtherLines(t *testing.T) {
+	reg := parseClients(t, clientsFile)
+	date := time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	for _, change := range []error{
+		reg.Set("globex", "region", "eu"),
+		reg.AddApp("globex", "web"),
+		reg.AddTag("globex", "beta"),
+		reg.Remove("initech", date),
+		reg.Add(&Client{Id: "umbrella", Apps: []string{"api"}, Attributes: map[string]string{"region": "us"}}),
+	} {
+		if change != nil {
+			t.Fatal(change)
+		}
+	}
+
+	assertContent(t, reg, `# clients of the platform
+client_id,apps,tags,region
+
+# beta clients
+acme, api;web ,beta,eu
+globex,api;web,beta,eu
+# deleted initech 2018-09-01T10:00:00Z: initech,api,,us
+# end of file
+umbrella,api,,us
+`)
+}
+
+func TestWriteNewColumn(t *testing.T) {
+	reg := parseClients(t, clientsFile)
+
+	if err := reg.Set("acme", "contact", "ops@acme.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, reg, `# clients of the platform
+client_id,apps,tags,region,contact
+
+# beta clients
+acme,api;web,beta,eu,ops@acme.com
+globex,api,,us,
+initech,api,,us,
+# end of file
+`)
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	reg := parseClients(t, clientsFile)
+	if err := reg.RemoveApp("acme", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Remove("globex", time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := reg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The written file reads back as the changed registry, globex being deleted
+	read := parseClients(t, string(content))
+	if len(read.Clients) != 2 || strings.Join(read.Get("acme").Apps, ",") != "api" || read.Get("globex") != nil {
+		t.Errorf("unexpected clients read back from:\n%s", content)
+	}
+	if tombstone := read.Tombstone("globex"); tombstone == nil || tombstone.Client == nil || tombstone.Client.Attributes["region"] != "us" {
+		t.Errorf("expected the tombstone of globex to keep its content, got %+v", tombstone)
+	}
+	assertContent(t, read, string(content))
+}
+
+func TestSaveAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clients.csv")
+	if err := ioutil.WriteFile(path, []byte(clientsFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.AddApp("initech", "web"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Replace(clientsFile, "initech,api,,us", "initech,api;web,,us", 1); string(content) != expected {
+		t.Errorf("expected saved clients file:\n%s\ngot:\n%s", expected, content)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the file mode to be kept, got %s", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected the temporary file to be renamed, got %d files", len(files))
+	}
+}
+
+func TestConvertKeepsComments(t *testing.T) {
+	reg := parseClients(t, clientsFile)
+	if err := reg.Remove("initech", time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Convert("clients.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := reg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := ReadFormat(bytes.NewReader(content), "clients.yaml", FormatYAML)
+	if err != nil {
+		t.Fatalf("%s:\n%s", err, content)
+	}
+	if strings.Join(converted.Comments, "|") != "clients of the platform|end of file" {
+		t.Errorf("expected comments of the file to be kept, got %q:\n%s", converted.Comments, content)
+	}
+	if acme := converted.Get("acme"); strings.Join(acme.Comments, "|") != "beta clients" {
+		t.Errorf("expected the comment preceding acme to be kept, got %q:\n%s", acme.Comments, content)
+	}
+	if len(converted.Get("globex").Comments) != 0 || converted.Tombstone("initech") == nil {
+		t.Errorf("expected globex without comment and initech deleted:\n%s", content)
+	}
+
+	if err := converted.Convert("clients.csv"); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, converted, `# clients of the platform
+# end of file
+client_id,apps,tags,region
+# beta clients
+acme,api;web,beta,eu
+globex,api,,us
+# deleted initech 2018-09-01T10:00:00Z: initech,api,,us
+`)
+}